@@ -29,9 +29,15 @@ func (q *Queue) Size() int {
 
 func (q *Queue) Push(x int) {
 	if q.Size()+1 >= len(q.b) {
+		// 一周している場合があるので先頭から並べ直す
+		n := q.Size()
 		buff := make([]int, 4*len(q.b))
-		copy(buff[:len(q.b)], q.b)
+		for i := 0; i < n; i++ {
+			buff[i] = q.b[(q.h+i)%len(q.b)]
+		}
 		q.b = buff
+		q.h = 0
+		q.t = n
 	}
 	q.b[q.t] = x
 	q.t = (q.t + 1) % len(q.b)
@@ -46,6 +52,22 @@ func (q *Queue) Pop() (res int) {
 	return
 }
 
+// Remove removes the first occurrence of x from the queue, keeping the order of the others.
+func (q *Queue) Remove(x int) bool {
+	n := q.Size()
+	for i := 0; i < n; i++ {
+		if q.b[(q.h+i)%len(q.b)] != x {
+			continue
+		}
+		for j := i; j+1 < n; j++ {
+			q.b[(q.h+j)%len(q.b)] = q.b[(q.h+j+1)%len(q.b)]
+		}
+		q.t = (q.t - 1 + len(q.b)) % len(q.b)
+		return true
+	}
+	return false
+}
+
 func (q *Queue) Print() {
 	for i := 0; i < q.Size(); i++ {
 		index := (q.h + i) % len(q.b)
@@ -70,3 +70,47 @@ func TestQueueExpand(t *testing.T) {
 	}
 
 }
+
+func TestQueueExpandWrapped(t *testing.T) {
+	q := algorithm.NewQueue(4)
+	q.Push(0)
+	q.Push(1)
+	q.Pop()
+	q.Pop()
+	// q.hが末尾にある状態で拡張する
+	for i := 2; i < 8; i++ {
+		q.Push(i)
+	}
+	for i := 2; i < 8; i++ {
+		if res := q.Pop(); res != i {
+			t.Errorf("expected: %d, actual: %d", i, res)
+		}
+	}
+	if !q.IsEmpty() {
+		t.Error("expected empty queue")
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	q := algorithm.NewQueue(4)
+	for i := 0; i < 6; i++ {
+		q.Push(i)
+	}
+	q.Pop()
+	q.Pop()
+	q.Push(6)
+	if !q.Remove(4) {
+		t.Error("expected 4 to be removed")
+	}
+	if q.Remove(0) {
+		t.Error("0 is not in the queue")
+	}
+	for _, expected := range []int{2, 3, 5, 6} {
+		if res := q.Pop(); res != expected {
+			t.Errorf("expected: %d, actual: %d", expected, res)
+		}
+	}
+	if !q.IsEmpty() {
+		t.Error("expected empty queue")
+	}
+}
@@ -2,4 +2,4 @@ module github.com/tychyDB
 
 go 1.16
 
-require github.com/goccy/go-graphviz v0.0.9 // indirect
+require github.com/goccy/go-graphviz v0.0.9
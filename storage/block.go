@@ -1,10 +1,9 @@
 package storage
 
-var UniqueBlockId uint32
-
-func init() {
-	UniqueBlockId = 0
-}
+import (
+	"encoding/binary"
+	"sync"
+)
 
 type BlockId struct {
 	fileName string
@@ -18,11 +17,40 @@ func NewBlockId(blockNum uint32, fileName string) BlockId {
 	return blk
 }
 
-func newUniqueBlockId(fileName string) BlockId {
-	blk := BlockId{}
-	blk.BlockNum = UniqueBlockId
-	blk.fileName = fileName
-	UniqueBlockId++
+// blockAllocator hands out the blocks of the storage file.
+// Its state is saved in the catalog page, so each storage file has its own.
+// The catalog page is rewritten on every change of the state, so that the free list on disk
+// never points at a page in use and no page in use is beyond nextBlk.
+// It is shared by the tables of the file, so mu guards the state.
+type blockAllocator struct {
+	fm       *FileMgr
+	mu       sync.Mutex
+	nextBlk  uint32 // まだ一度も使われていない最初のブロック
+	freeHead uint32 // 空きページのチェーンの先頭
+	catalog  []byte // 最後に書いたカタログページ。nilならまだ書いていない
+}
+
+func newBlockAllocator(fm *FileMgr) *blockAllocator {
+	alloc := &blockAllocator{}
+	alloc.fm = fm
+	alloc.nextBlk = 0
+	alloc.freeHead = NullBlockNum
+	return alloc
+}
+
+// newBlock returns a block that has never been used
+func (alloc *blockAllocator) newBlock() BlockId {
+	blk := NewBlockId(alloc.nextBlk, StorageFile)
+	alloc.nextBlk++
 	return blk
+}
 
+// persist writes nextBlk and freeHead to the catalog page. mu must be held.
+func (alloc *blockAllocator) persist() error {
+	if alloc.catalog == nil {
+		return nil
+	}
+	binary.BigEndian.PutUint32(alloc.catalog[formatHeaderSize:], alloc.nextBlk)
+	binary.BigEndian.PutUint32(alloc.catalog[formatHeaderSize+IntSize:], alloc.freeHead)
+	return alloc.fm.Write(NewBlockId(0, StorageFile), sealPage(alloc.catalog))
 }
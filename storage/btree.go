@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+// btree is a B+tree whose leaves hold KeyValueCells ordered by cmp.
+// A table and each of its secondary indexes are btrees sharing the page table.
+// Pages are split when their serialized size exceeds limit bytes.
+//
+// Searches and inserts may run concurrently: they latch pages from the root down,
+// releasing the latches of the ancestors once a page is known not to change (latch crabbing).
+// Deletes and the other operations are run alone on the table by Storage.
+type btree struct {
+	ptb       *PageTable
+	alloc     *blockAllocator
+	root      *BlockId      // テーブルのメタ情報にあるrootを指す
+	rootLatch *sync.RWMutex // rootの付け替えを守る
+	cmp       Comparator
+	limit     uint32
+	freed     []BlockId // 併合で空になったページ。ピンが外れてから解放する
+	held      []BlockId // insertが排他ラッチを持っているページ
+	rootHeld  bool      // insertがrootLatchを持っているか
+}
+
+// newRootPage allocates the empty root of a new btree
+func newRootPage(ptb *PageTable, alloc *blockAllocator) (BlockId, error) {
+	blk, err := alloc.allocate()
+	if err != nil {
+		return BlockId{}, err
+	}
+	if err := ptb.set(blk, newPage(false, ptb.pageSize())); err != nil {
+		return BlockId{}, err
+	}
+	ptb.unlatch(blk, latchExclusive)
+	return blk, nil
+}
+
+// latchRoot latches the root page in mode. The root cannot be replaced while it is latched.
+func (bt *btree) latchRoot(mode latchMode) (BlockId, *Page, error) {
+	bt.rootLatch.RLock()
+	defer bt.rootLatch.RUnlock()
+	rootBlk := *bt.root
+	rootPage, err := bt.ptb.latch(rootBlk, mode)
+	return rootBlk, rootPage, err
+}
+
+func (bt *btree) isEmpty() (bool, error) {
+	rootBlk, rootPage, err := bt.latchRoot(latchShared)
+	if err != nil {
+		return false, err
+	}
+	defer bt.ptb.unlatch(rootBlk, latchShared)
+	return rootPage.header.numOfPtr == 0, nil
+}
+
+// safe reports whether inserting cell below pg doesn't split pg.
+func (bt *btree) safe(pg *Page, cell KeyValueCell) bool {
+	var size uint32
+	if pg.header.isLeaf {
+		size = slotOverhead + cell.getSize()
+	} else {
+		// 子が分割されると区切りキーのセルが1つ増える
+		size = slotOverhead + KeyCell{key: make([]byte, maxKeySize(pg.size))}.getSize()
+	}
+	used := pg.usedBytes() + size
+	return used <= bt.limit && used <= pg.size
+}
+
+// releaseHeld releases the latches held by insert.
+func (bt *btree) releaseHeld() {
+	for _, blk := range bt.held {
+		bt.ptb.unlatch(blk, latchExclusive)
+	}
+	bt.held = nil
+	if bt.rootHeld {
+		bt.rootHeld = false
+		bt.rootLatch.Unlock()
+	}
+}
+
+func (bt *btree) insert(cell KeyValueCell, replace bool) error {
+	if uint32(len(cell.key)) > maxKeySize(bt.ptb.pageSize()) {
+		return ErrKeyTooLarge
+	}
+	if cell.getSize() > maxCellSize(bt.ptb.pageSize()) {
+		return ErrRecordTooLarge
+	}
+	// rootが分割されるかもしれないので、rootの付け替えも排他で押さえておく
+	bt.rootLatch.Lock()
+	bt.rootHeld = true
+	defer bt.releaseHeld()
+	rootBlk := *bt.root
+	rootPage, err := bt.ptb.latch(rootBlk, latchExclusive)
+	if err != nil {
+		return err
+	}
+	bt.held = append(bt.held, rootBlk)
+	if rootPage.header.numOfPtr == 0 {
+		pg := newPage(true, bt.ptb.pageSize())
+		blk, err := bt.alloc.allocate()
+		if err != nil {
+			return err
+		}
+		if err := bt.ptb.set(blk, pg); err != nil {
+			return err
+		}
+		// rightmostのキーは比較に使われない
+		rootPage.setEntries([]Cell{KeyCell{pageIndex: blk.BlockNum}})
+		pg.setEntries([]Cell{cell})
+		bt.ptb.unlatch(blk, latchExclusive)
+		return nil
+	}
+	if bt.safe(rootPage, cell) {
+		bt.rootHeld = false
+		bt.rootLatch.Unlock()
+	}
+	splitted, splitKey, leftPageIndex, err := rootPage.addRecordRec(bt, cell, replace)
+	if err != nil {
+		return err
+	}
+	if !splitted {
+		return nil
+	}
+	newRootPage := newPage(false, bt.ptb.pageSize())
+	blk, err := bt.alloc.allocate()
+	if err != nil {
+		return err
+	}
+	if err := bt.ptb.set(blk, newRootPage); err != nil {
+		return err
+	}
+	newRootPage.setEntries([]Cell{
+		KeyCell{key: splitKey, pageIndex: leftPageIndex},
+		KeyCell{pageIndex: rootBlk.BlockNum},
+	})
+	bt.ptb.unlatch(blk, latchExclusive)
+	*bt.root = blk
+	return nil
+}
+
+func (bt *btree) delete(key []byte) error {
+	rootBlk, rootPage, err := bt.latchRoot(latchExclusive)
+	if err != nil {
+		return err
+	}
+	if rootPage.header.numOfPtr == 0 {
+		bt.ptb.unlatch(rootBlk, latchExclusive)
+		return ErrKeyNotFound
+	}
+	if _, err := rootPage.deleteRecordRec(bt, key); err != nil {
+		bt.ptb.unlatch(rootBlk, latchExclusive)
+		return err
+	}
+	// rootの子が1つだけになったら、その子を新しいrootにする
+	// 子がリーフの場合は空のrootを作らないためにそのままにしておく
+	if rootPage.header.numOfPtr == 1 {
+		childBlk := NewBlockId(rootPage.childAt(0), StorageFile)
+		child, err := bt.ptb.latch(childBlk, latchShared)
+		if err != nil {
+			bt.ptb.unlatch(rootBlk, latchExclusive)
+			return err
+		}
+		if !child.header.isLeaf {
+			bt.rootLatch.Lock()
+			*bt.root = childBlk
+			bt.rootLatch.Unlock()
+			bt.freed = append(bt.freed, rootBlk)
+		}
+		bt.ptb.unlatch(childBlk, latchShared)
+	}
+	bt.ptb.unlatch(rootBlk, latchExclusive)
+	return bt.release()
+}
+
+// release puts the pages emptied by merges on the free list.
+func (bt *btree) release() error {
+	for i, blk := range bt.freed {
+		if err := bt.alloc.free(bt.ptb, blk); err != nil {
+			bt.freed = bt.freed[i:]
+			return err
+		}
+	}
+	bt.freed = nil
+	return nil
+}
+
+// search returns the leaf where key is stored or would be inserted.
+// The leaf is returned latched in shared mode.
+func (bt *btree) search(key []byte) (BlockId, *Page, error) {
+	return bt.upperBound(bt.cmp, key)
+}
+
+// upperBound returns the rightmost leaf that may hold a key equal to key under cmp.
+func (bt *btree) upperBound(cmp Comparator, key []byte) (BlockId, *Page, error) {
+	return bt.descend(func(pg *Page) uint32 {
+		return pg.childIndex(cmp, key)
+	})
+}
+
+// lowerBound returns the leftmost leaf that may hold a key equal to key under cmp.
+// 接頭辞で比較すると等しいキーが複数の子にまたがるので、等しいキーがあれば左の子に降りる
+func (bt *btree) lowerBound(cmp Comparator, key []byte) (BlockId, *Page, error) {
+	return bt.descend(func(pg *Page) uint32 {
+		for i, ptr := range pg.ptrs {
+			if cmp(key, pg.cells[ptr].getKey()) <= 0 {
+				return uint32(i)
+			}
+		}
+		return pg.header.numOfPtr - 1
+	})
+}
+
+// edgeLeaf returns the leftmost leaf, or the rightmost leaf if rightmost is true.
+func (bt *btree) edgeLeaf(rightmost bool) (BlockId, *Page, error) {
+	return bt.descend(func(pg *Page) uint32 {
+		if rightmost {
+			return pg.header.numOfPtr - 1
+		}
+		return 0
+	})
+}
+
+// descend follows choose from the root to a leaf and returns the leaf latched in shared mode.
+// 子のラッチを取ってから親のラッチを外す
+func (bt *btree) descend(choose func(pg *Page) uint32) (BlockId, *Page, error) {
+	curBlk, curPage, err := bt.latchRoot(latchShared)
+	if err != nil {
+		return BlockId{}, nil, err
+	}
+	if curPage.header.numOfPtr == 0 {
+		panic(errors.New("unexpected"))
+	}
+	for !curPage.header.isLeaf {
+		childBlk := NewBlockId(curPage.childAt(choose(curPage)), StorageFile)
+		childPage, err := bt.ptb.latch(childBlk, latchShared)
+		bt.ptb.unlatch(curBlk, latchShared)
+		if err != nil {
+			return BlockId{}, nil, err
+		}
+		curBlk = childBlk
+		curPage = childPage
+	}
+	return curBlk, curPage, nil
+}
+
+// compact compacts every page of the tree.
+func (bt *btree) compact() error {
+	return bt.walk(latchExclusive, func(pg *Page) {
+		pg.compact()
+	})
+}
+
+// pages returns the blocks of all the pages of the tree.
+func (bt *btree) pages() ([]BlockId, error) {
+	var blks []BlockId
+	err := bt.walk(latchShared, func(pg *Page) {
+		blks = append(blks, pg.blk)
+	})
+	return blks, err
+}
+
+// walk calls fn for each page of the tree, parents first.
+// The pages are latched in mode, so walk must not run concurrently with inserts.
+// 全てのページを読むので、バッファプールにはリングを通して読み込む
+func (bt *btree) walk(mode latchMode, fn func(pg *Page)) error {
+	return bt.walkRec(*bt.root, mode, bt.ptb.newRing(), fn)
+}
+
+func (bt *btree) walkRec(blk BlockId, mode latchMode, ring *bufferRing, fn func(pg *Page)) error {
+	pg, err := bt.ptb.latchWith(blk, mode, ring)
+	if err != nil {
+		return err
+	}
+	defer bt.ptb.unlatch(blk, mode)
+	fn(pg)
+	if pg.header.isLeaf {
+		return nil
+	}
+	for i := uint32(0); i < pg.header.numOfPtr; i++ {
+		if err := bt.walkRec(NewBlockId(pg.childAt(i), StorageFile), mode, ring, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
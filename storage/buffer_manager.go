@@ -3,22 +3,27 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
+// MaxBufferPoolSize is the default number of pages in the buffer pool
 const MaxBufferPoolSize = 10
 
+// Buffer is a frame of the buffer pool.
+// The page is read under the shared latch and modified under the exclusive latch.
+// ラッチはpinしている間だけ取れる。pinされたフレームは追い出されない
 type Buffer struct {
-	pin     bool
-	ref     bool
+	pins    int // pinしている呼び出し元の数
 	blk     BlockId
 	content *Page
+	latch   sync.RWMutex
 }
 
 func newBufferFromPage(blk BlockId, pg *Page) *Buffer {
 	buff := &Buffer{}
 	buff.content = pg
-	buff.pin = false
-	buff.ref = false
+	pg.blk = blk
+	buff.pins = 0
 	buff.blk = blk
 	return buff
 }
@@ -30,91 +35,95 @@ func (buff *Buffer) page() *Page {
 func (buff *Buffer) Print() {
 	fmt.Printf("Buffer {")
 	fmt.Printf("BlockID %d, ", buff.blk.BlockNum)
-	if buff.pin {
-		fmt.Print("pin, ")
+	if buff.pins > 0 {
+		fmt.Printf("pin %d, ", buff.pins)
 	} else {
 		fmt.Print("unpin, ")
 	}
-	fmt.Printf("ref {%v}", buff.ref)
+	fmt.Printf("dirty {%v}", buff.content.dirty)
 	fmt.Printf("}")
 }
 
+// BufferMgr holds the frames of the buffer pool. It is used under the lock of the PageTable.
 type BufferMgr struct {
 	fm   *FileMgr
 	pool []*Buffer
 }
 
 func NewBufferMgr(fm *FileMgr) *BufferMgr {
+	return newBufferMgr(fm, MaxBufferPoolSize)
+}
+
+func newBufferMgr(fm *FileMgr, size int) *BufferMgr {
 	bm := &BufferMgr{}
 	bm.fm = fm
-	bm.pool = make([]*Buffer, MaxBufferPoolSize)
+	bm.pool = make([]*Buffer, size)
 	return bm
 }
 
+func (bm *BufferMgr) size() int {
+	return len(bm.pool)
+}
+
 func (bm *BufferMgr) pageAt(buffId int) *Page {
 	return bm.pool[buffId].page()
 }
 
-func (bm *BufferMgr) allocate(buff *Buffer) int {
-	for i := 0; i < MaxBufferPoolSize; i++ {
+func (bm *BufferMgr) allocate(buff *Buffer) (int, error) {
+	for i := 0; i < bm.size(); i++ {
 		if bm.pool[i] == nil {
 			bm.pool[i] = buff
-			return i
+			return i, nil
 		}
 	}
-	panic(errors.New("no space for page"))
+	return 0, ErrBufferPoolFull
 }
 
-func (bm *BufferMgr) load(blk BlockId) int {
-	n, bytes := bm.fm.Read(blk)
+func (bm *BufferMgr) load(blk BlockId) (int, error) {
+	n, bytes, err := bm.fm.Read(blk)
+	if err != nil {
+		return 0, err
+	}
 	if n == 0 {
 		panic(errors.New("invalid BlockId was selected"))
 	}
 
-	pg := newPageFromBytes(bytes)
-	buff := newBufferFromPage(blk, pg)
-	for i := 0; i < MaxBufferPoolSize; i++ {
-		if bm.pool[i] == nil {
-			bm.pool[i] = buff
-			return i
-		}
+	pg, err := newPageFromBytes(bytes)
+	if err != nil {
+		return 0, fmt.Errorf("%w: block %d of %s", err, blk.BlockNum, blk.fileName)
 	}
-	panic(errors.New("no space for page"))
+	return bm.allocate(newBufferFromPage(blk, pg))
 }
 
-func (bm *BufferMgr) flush(buffId int) {
+// flush writes the page back if it is dirty and frees the buffer.
+// 書き込みに失敗したらページはバッファに残す
+func (bm *BufferMgr) flush(buffId int) error {
 	buff := bm.pool[buffId]
-	bm.fm.Write(buff.blk, buff.page().toBytes())
+	if buff.page().dirty {
+		if err := bm.fm.Write(buff.blk, buff.page().toBytes()); err != nil {
+			return err
+		}
+	}
 	bm.pool[buffId] = nil
+	return nil
 }
 
 func (bm *BufferMgr) isPinned(buffId int) bool {
 	buff := bm.pool[buffId]
-	return buff.pin
+	return buff.pins > 0
 }
 
 func (bm *BufferMgr) pin(buffId int) {
 	buff := bm.pool[buffId]
-	buff.pin = true
-	buff.ref = true
+	buff.pins++
 }
 
 func (bm *BufferMgr) unpin(buffId int) {
 	buff := bm.pool[buffId]
-	if !buff.pin {
+	if buff.pins == 0 {
 		panic(errors.New("pin is already unpinned"))
 	}
-	buff.pin = false
-}
-
-func (bm *BufferMgr) isRefed(buffId int) bool {
-	buff := bm.pool[buffId]
-	return buff.ref
-}
-
-func (bm *BufferMgr) unRef(buffId int) {
-	buff := bm.pool[buffId]
-	buff.ref = false
+	buff.pins--
 }
 
 func (bm *BufferMgr) clear(buffId int) {
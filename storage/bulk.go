@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	ErrNotEmpty          = errors.New("table is not empty")
+	ErrInvalidFillFactor = errors.New("fill factor must be between 0.1 and 1")
+	ErrBulkTooLarge      = errors.New("too many rows to bulk load")
+)
+
+const minFillFactor = 0.1
+
+// MaxBulkLoadRows is the maximum number of rows BulkLoad accepts at once.
+// The keys of all rows are sorted in memory, so larger inputs have to be split and added by Add.
+const MaxBulkLoadRows = 1 << 24
+
+// BulkLoad loads rows into an empty table.
+// The rows are sorted by the primary key and packed into leaf pages up to fillFactor,
+// then the internal levels are built on top of them. The pages are written through FileMgr
+// instead of the buffer pool.
+// Only the keys are kept in memory; the records are encoded while the leaves are written.
+// On error the table is left empty and every page allocated for it is freed.
+func (st *Storage) BulkLoad(rows [][]interface{}, fillFactor float64) error {
+	st.lock()
+	defer st.unlock()
+	return st.bulkLoad(rows, fillFactor)
+}
+
+// bulkEntry is the key of a row to be loaded and the position of the row in the input.
+type bulkEntry struct {
+	key []byte
+	row int
+}
+
+func (st *Storage) bulkLoad(rows [][]interface{}, fillFactor float64) error {
+	if fillFactor < minFillFactor || fillFactor > 1 {
+		return ErrInvalidFillFactor
+	}
+	if len(rows) > MaxBulkLoadRows {
+		return ErrBulkTooLarge
+	}
+	if empty, err := st.isEmpty(); err != nil {
+		return err
+	} else if !empty {
+		return ErrNotEmpty
+	}
+
+	// 書き込む前にすべての行を確かめる。ここではオーバーフローページを確保しない
+	pageSize := st.fm.PageSize()
+	noSpill := func([]byte) (uint32, error) { return 0, nil }
+	entries := make([]bulkEntry, len(rows))
+	for i, args := range rows {
+		data, err := encode(st.cols, noSpill, args...)
+		if err != nil {
+			return err
+		}
+		// newRecordはusedを立てるので、書き込みが決まるまでは使わない
+		rec := Record{version: st.version(), size: uint32(len(data)), data: data}
+		key, err := st.keyOf(rec)
+		if err != nil {
+			return err
+		}
+		if uint32(len(key)) > maxKeySize(pageSize) {
+			return ErrKeyTooLarge
+		}
+		if (KeyValueCell{key: key, rec: rec}).getSize() > maxCellSize(pageSize) {
+			return ErrRecordTooLarge
+		}
+		entries[i] = bulkEntry{key: key, row: i}
+	}
+	cmp := st.comparator()
+	if err := sortEntries(entries, cmp, cmp); err != nil {
+		return err
+	}
+
+	// インデックスのキーも先に作って、一意性を確認してから書き込む
+	indexEntries := make([][]bulkEntry, len(st.indexes))
+	for i, im := range st.indexes {
+		for _, e := range entries {
+			secKey, ok := st.secondaryKey(i, rows[e.row])
+			if !ok {
+				continue
+			}
+			key := append(secKey, e.key...)
+			if uint32(len(key)) > maxKeySize(pageSize) {
+				return ErrKeyTooLarge
+			}
+			indexEntries[i] = append(indexEntries[i], bulkEntry{key: key})
+		}
+		var dup Comparator
+		if im.unique {
+			dup = NewKeyComparator(st.indexCols(i))
+		}
+		if err := sortEntries(indexEntries[i], st.indexTree(i).cmp, dup); err != nil {
+			return err
+		}
+	}
+
+	// 失敗したら、それまでに確保したページをすべて返す
+	w := &treeWriter{alloc: st.cat.alloc, limit: pageLimit(pageSize, fillFactor), pageSize: pageSize}
+	roots, err := st.writeTrees(w, rows, entries, indexEntries)
+	if err != nil {
+		if ferr := st.freeBlocks(w.blks); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+	return st.setRoots(roots)
+}
+
+// writeTrees writes the trees of the table and its indexes and returns the entries of their roots.
+func (st *Storage) writeTrees(w *treeWriter, rows [][]interface{}, entries []bulkEntry, indexEntries [][]bulkEntry) ([][]Cell, error) {
+	spill := func(data []byte) (uint32, error) {
+		blks, err := writeOverflow(st.cat.alloc, data)
+		w.blks = append(w.blks, blks...)
+		if err != nil {
+			return 0, err
+		}
+		return blks[0].BlockNum, nil
+	}
+	roots := make([][]Cell, 0, 1+len(indexEntries))
+	w.reset()
+	for _, e := range entries {
+		data, err := encode(st.cols, spill, rows[e.row]...)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.add(KeyValueCell{key: e.key, rec: st.newRecord(data)}); err != nil {
+			return nil, err
+		}
+	}
+	root, err := w.finish()
+	if err != nil {
+		return nil, err
+	}
+	roots = append(roots, root)
+	for _, ies := range indexEntries {
+		w.reset()
+		for _, e := range ies {
+			if err := w.add(KeyValueCell{key: e.key}); err != nil {
+				return nil, err
+			}
+		}
+		if root, err = w.finish(); err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// setRoots puts the entries of the roots written by writeTrees into the root pages of the table and its indexes.
+func (st *Storage) setRoots(roots [][]Cell) error {
+	blks := []BlockId{st.rootBlk}
+	for _, im := range st.indexes {
+		blks = append(blks, im.rootBlk)
+	}
+	pages := make([]*Page, len(blks))
+	for i, blk := range blks {
+		pg, err := st.ptb.latch(blk, latchExclusive)
+		if err != nil {
+			for _, held := range blks[:i] {
+				st.ptb.unlatch(held, latchExclusive)
+			}
+			return err
+		}
+		pages[i] = pg
+	}
+	for i, blk := range blks {
+		if len(roots[i]) > 0 {
+			pages[i].setEntries(roots[i])
+		}
+		st.ptb.unlatch(blk, latchExclusive)
+	}
+	return nil
+}
+
+// sortEntries sorts entries by cmp and returns ErrDuplicateKey if adjacent entries are equal under dup.
+func sortEntries(entries []bulkEntry, cmp Comparator, dup Comparator) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return cmp(entries[i].key, entries[j].key) < 0
+	})
+	if dup == nil {
+		return nil
+	}
+	for i := 1; i < len(entries); i++ {
+		if dup(entries[i-1].key, entries[i].key) == 0 {
+			return ErrDuplicateKey
+		}
+	}
+	return nil
+}
+
+// pack groups entries into pages filled up to limit bytes.
+// 内部ノードは子を2つ以上持つようにする
+func pack(isLeaf bool, entries []Cell, limit, pageSize uint32) [][]Cell {
+	least := 1
+	if !isLeaf {
+		least = 2
+	}
+	var pages [][]Cell
+	for start := 0; start < len(entries); {
+		end := start
+		size := uint32(PageHeaderSize)
+		for end < len(entries) {
+			next := size + slotOverhead + entries[end].getSize()
+			if end-start >= least && next > limit {
+				break
+			}
+			size = next
+			end++
+		}
+		pages = append(pages, entries[start:end])
+		start = end
+	}
+	if last := len(pages) - 1; last > 0 && len(pages[last]) < least {
+		// 前のページとならす
+		prev := pages[last-1]
+		merged := entries[len(entries)-len(prev)-len(pages[last]):]
+		if usedBytes(isLeaf, merged) <= pageSize {
+			pages = append(pages[:last-1], merged)
+		} else {
+			pages[last-1] = prev[:len(prev)-1]
+			pages[last] = merged[len(prev)-1:]
+		}
+	}
+	return pages
+}
+
+type subtree struct {
+	blkNum uint32
+	minKey []byte
+}
+
+// treeWriter writes a btree from sorted cells through FileMgr.
+// リーフは埋まった順に書き出すので、メモリに持つのは書きかけのリーフと子の一覧だけ
+type treeWriter struct {
+	alloc    *blockAllocator
+	limit    uint32
+	pageSize uint32
+	blks     []BlockId // 確保したブロック。オーバーフローページも含む
+
+	entries []Cell
+	size    uint32
+	prev    *Page
+	prevBlk BlockId
+	level   []subtree
+}
+
+func (w *treeWriter) reset() {
+	w.entries, w.size, w.prev, w.level = nil, PageHeaderSize, nil, nil
+}
+
+func (w *treeWriter) allocate() (BlockId, error) {
+	blk, err := w.alloc.allocate()
+	if err != nil {
+		return BlockId{}, err
+	}
+	w.blks = append(w.blks, blk)
+	return blk, nil
+}
+
+// add appends cell to the current leaf, writing out the leaf first if cell doesn't fit in it.
+func (w *treeWriter) add(cell Cell) error {
+	next := w.size + slotOverhead + cell.getSize()
+	if len(w.entries) > 0 && next > w.limit {
+		if err := w.flushLeaf(); err != nil {
+			return err
+		}
+		next = w.size + slotOverhead + cell.getSize()
+	}
+	w.entries = append(w.entries, cell)
+	w.size = next
+	return nil
+}
+
+// flushLeaf links the current leaf to the previous one and writes out the previous one.
+func (w *treeWriter) flushLeaf() error {
+	pg := newPage(true, w.pageSize)
+	pg.setEntries(w.entries)
+	blk, err := w.allocate()
+	if err != nil {
+		return err
+	}
+	if w.prev != nil {
+		w.prev.header.nextPtr = blk.BlockNum
+		pg.header.prevPtr = w.prevBlk.BlockNum
+		if err := w.alloc.fm.Write(w.prevBlk, w.prev.toBytes()); err != nil {
+			return err
+		}
+	}
+	w.level = append(w.level, subtree{blkNum: blk.BlockNum, minKey: w.entries[0].getKey()})
+	w.prev, w.prevBlk = pg, blk
+	w.entries, w.size = nil, PageHeaderSize
+	return nil
+}
+
+// finish writes out the remaining leaves and the internal levels, and returns the entries of the root.
+func (w *treeWriter) finish() ([]Cell, error) {
+	if len(w.entries) > 0 {
+		if err := w.flushLeaf(); err != nil {
+			return nil, err
+		}
+	}
+	if w.prev == nil {
+		return nil, nil
+	}
+	if err := w.alloc.fm.Write(w.prevBlk, w.prev.toBytes()); err != nil {
+		return nil, err
+	}
+
+	// rootに収まるまで内部ノードの段を積む
+	level := w.level
+	for {
+		entries := internalEntries(level)
+		if usedBytes(false, entries) <= w.limit || len(level) <= 2 {
+			return entries, nil
+		}
+		var upper []subtree
+		pos := 0
+		for _, children := range pack(false, entries, w.limit, w.pageSize) {
+			pg := newPage(false, w.pageSize)
+			pg.setEntries(children)
+			blk, err := w.allocate()
+			if err != nil {
+				return nil, err
+			}
+			if err := w.alloc.fm.Write(blk, pg.toBytes()); err != nil {
+				return nil, err
+			}
+			upper = append(upper, subtree{blkNum: blk.BlockNum, minKey: level[pos].minKey})
+			pos += len(children)
+		}
+		level = upper
+	}
+}
+
+// internalEntries returns the cells of an internal page pointing to children.
+// 子iのキーはすべて次の子の最小キーより小さい。rightmostのキーは比較に使われない
+func internalEntries(children []subtree) []Cell {
+	entries := make([]Cell, len(children))
+	for i, child := range children {
+		cell := KeyCell{pageIndex: child.blkNum}
+		if i+1 < len(children) {
+			cell.key = children[i+1].minKey
+		}
+		entries[i] = cell
+	}
+	return entries
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/tychyDB/util"
+)
+
+// DefaultTable is the table used by NewStorage and NewStorageFromFile
+const DefaultTable = "default"
+
+var (
+	ErrTableExists   = errors.New("table already exists")
+	ErrTableNotFound = errors.New("table not found")
+	ErrCatalogFull   = errors.New("no space left in catalog page")
+)
+
+type tableEntry struct {
+	name    string
+	metaBlk BlockId
+}
+
+func (ent tableEntry) size() uint32 {
+	return 2*IntSize + uint32(len(ent.name))
+}
+
+// Catalog is the system catalog placed at the top of the storage file.
+// It maps each table name to the meta page that holds the table's columns and root block.
+// It is safe for concurrent use.
+type Catalog struct {
+	fm     *FileMgr
+	ptb    *PageTable
+	blk    BlockId
+	alloc  *blockAllocator
+	mu     sync.Mutex // tablesとopenを守る
+	tables []tableEntry
+	open   map[string]*Storage
+}
+
+func NewCatalog(fm *FileMgr, ptb *PageTable) *Catalog {
+	cat, err := newCatalog(fm, ptb)
+	if err != nil {
+		panic(err)
+	}
+	return cat
+}
+
+func NewCatalogFromFile(fm *FileMgr, ptb *PageTable) *Catalog {
+	cat, err := openCatalog(fm, ptb)
+	if err != nil {
+		panic(err)
+	}
+	return cat
+}
+
+func newCatalog(fm *FileMgr, ptb *PageTable) (*Catalog, error) {
+	cat := &Catalog{}
+	cat.fm = fm
+	cat.ptb = ptb
+	cat.alloc = newBlockAllocator(fm)
+	cat.blk = cat.alloc.newBlock()
+	if cat.blk.BlockNum != 0 {
+		panic(errors.New("place a catalog page at the top of the file"))
+	}
+	cat.tables = []tableEntry{}
+	cat.open = make(map[string]*Storage)
+	if err := cat.writePage(); err != nil {
+		return nil, err
+	}
+	return cat, nil
+}
+
+func openCatalog(fm *FileMgr, ptb *PageTable) (*Catalog, error) {
+	cat := &Catalog{}
+	cat.fm = fm
+	cat.ptb = ptb
+	cat.blk = NewBlockId(0, StorageFile)
+	cat.alloc = newBlockAllocator(fm)
+	cat.open = make(map[string]*Storage)
+	if err := cat.load(); err != nil {
+		return nil, err
+	}
+	return cat, nil
+}
+
+func (cat *Catalog) load() error {
+	_, bytes, err := cat.fm.Read(cat.blk)
+	if err != nil {
+		return err
+	}
+	if err := checkPage(bytes); err != nil {
+		return err
+	}
+	iter := util.NewIterStruct(formatHeaderSize, bytes)
+	cat.alloc.mu.Lock()
+	cat.alloc.nextBlk = iter.NextUInt32()
+	cat.alloc.freeHead = iter.NextUInt32()
+	cat.alloc.catalog = bytes
+	cat.alloc.mu.Unlock()
+	numTables := iter.NextUInt32()
+	cat.tables = make([]tableEntry, numTables)
+	for i := 0; i < int(numTables); i++ {
+		nameLen := iter.NextUInt32()
+		name := iter.NextStringWithSize(nameLen)
+		metaBlk := NewBlockId(iter.NextUInt32(), StorageFile)
+		cat.tables[i] = tableEntry{name: name, metaBlk: metaBlk}
+	}
+	return nil
+}
+
+func (cat *Catalog) size() uint32 {
+	size := uint32(formatHeaderSize + 3*IntSize + trailerSize)
+	for _, ent := range cat.tables {
+		size += ent.size()
+	}
+	return size
+}
+
+// toBytes serializes the catalog page. cat.alloc.mu must be held.
+func (cat *Catalog) toBytes() []byte {
+	gen := util.NewGenStruct(0, cat.fm.PageSize())
+	gen.PutUInt32(magicNumber)
+	gen.PutUInt32(FormatVersion)
+	gen.PutUInt32(cat.fm.PageSize())
+	gen.PutUInt32(cat.alloc.nextBlk)
+	gen.PutUInt32(cat.alloc.freeHead)
+	gen.PutUInt32(uint32(len(cat.tables)))
+	for _, ent := range cat.tables {
+		nameLen := uint32(len(ent.name))
+		gen.PutUInt32(nameLen)
+		gen.PutStringWithSize(ent.name, nameLen)
+		gen.PutUInt32(ent.metaBlk.BlockNum)
+	}
+	return sealPage(gen.DumpBytes())
+}
+
+func (cat *Catalog) writePage() error {
+	// 空きリストの変更もこのページに書くので、書き込みを順序づける
+	cat.alloc.mu.Lock()
+	defer cat.alloc.mu.Unlock()
+	cat.alloc.catalog = cat.toBytes()
+	return cat.fm.Write(cat.blk, cat.alloc.catalog)
+}
+
+func (cat *Catalog) lookup(name string) int {
+	for i, ent := range cat.tables {
+		if ent.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (cat *Catalog) Tables() []string {
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	names := make([]string, len(cat.tables))
+	for i, ent := range cat.tables {
+		names[i] = ent.name
+	}
+	return names
+}
+
+func (cat *Catalog) CreateTable(name string) (*Storage, error) {
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	if cat.lookup(name) != -1 {
+		return nil, ErrTableExists
+	}
+	ent := tableEntry{name: name}
+	if cat.size()+ent.size() > cat.fm.PageSize() {
+		return nil, ErrCatalogFull
+	}
+
+	st := newStorage(cat, name)
+	var err error
+	// テーブルのメタ情報を置くためのページ
+	if st.metaBlk, err = cat.alloc.allocate(); err != nil {
+		return nil, err
+	}
+	// rootノード
+	if st.rootBlk, err = newRootPage(st.ptb, cat.alloc); err != nil {
+		return nil, err
+	}
+	st.cols = []Column{}
+	if err := st.writeMeta(); err != nil {
+		return nil, err
+	}
+
+	ent.metaBlk = st.metaBlk
+	cat.tables = append(cat.tables, ent)
+	cat.open[name] = st
+	if err := cat.writePage(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (cat *Catalog) OpenTable(name string) (*Storage, error) {
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	return cat.openTable(name)
+}
+
+func (cat *Catalog) openTable(name string) (*Storage, error) {
+	if st, exists := cat.open[name]; exists {
+		return st, nil
+	}
+	idx := cat.lookup(name)
+	if idx == -1 {
+		return nil, ErrTableNotFound
+	}
+	st := newStorage(cat, name)
+	meta, err := readMeta(cat.fm, cat.tables[idx].metaBlk)
+	if err != nil {
+		return nil, err
+	}
+	st.MetaPage = meta
+	cat.open[name] = st
+	return st, nil
+}
+
+// CreateIndex builds a secondary index on the columns of the table.
+func (cat *Catalog) CreateIndex(table string, columns []string, unique bool) error {
+	st, err := cat.OpenTable(table)
+	if err != nil {
+		return err
+	}
+	return st.CreateIndex(columns, unique)
+}
+
+// DropTable removes the table from the catalog.
+// The pages owned by the table are put on the free list and reused by new pages.
+func (cat *Catalog) DropTable(name string) error {
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	st, err := cat.openTable(name)
+	if err != nil {
+		return err
+	}
+	st.lock()
+	defer st.unlock()
+	if err := st.release(); err != nil {
+		return err
+	}
+	idx := cat.lookup(name)
+	cat.tables = append(cat.tables[:idx], cat.tables[idx+1:]...)
+	delete(cat.open, name)
+	return cat.writePage()
+}
+
+// Vacuum removes the free pages at the end of the storage file and shrinks the file.
+// It returns the number of pages removed.
+func (cat *Catalog) Vacuum() (uint32, error) {
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	removed, err := cat.alloc.vacuum()
+	if err != nil {
+		return 0, err
+	}
+	return removed, cat.writePage()
+}
+
+func (cat *Catalog) Flush() error {
+	if err := cat.ptb.Flush(); err != nil {
+		return err
+	}
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	for _, st := range cat.open {
+		st.latch.RLock()
+		err := st.writeMeta()
+		st.latch.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := cat.writePage(); err != nil {
+		return err
+	}
+	return cat.fm.Sync(StorageFile)
+}
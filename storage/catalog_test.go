@@ -0,0 +1,478 @@
+package storage_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tychyDB/storage"
+)
+
+func TestCatalogMultiTable(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	cat := storage.NewCatalog(fm, ptb)
+
+	users, err := cat.CreateTable("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.AddColumn("id", storage.IntergerType)
+	users.AddColumn("username", storage.CharType(16))
+	users.Add(3, "tychy")
+	users.Add(1, "yokonao")
+
+	projects, err := cat.CreateTable("projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects.AddColumn("id", storage.IntergerType)
+	projects.AddColumn("owner", storage.IntergerType)
+	projects.Add(10, 1)
+	projects.Add(20, 3)
+	projects.Add(30, 3)
+
+	if _, err := cat.CreateTable("users"); err != storage.ErrTableExists {
+		t.Errorf("expected ErrTableExists, actual: %v", err)
+	}
+	cat.Flush()
+
+	cat = storage.NewCatalogFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	users, err = cat.OpenTable("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := users.Select(false, "id", "username")
+	if err != nil {
+		t.Error("failure select")
+	}
+	if res[1][0].(string) != "yokonao" {
+		t.Errorf("expected: yokonao, actual: %s", res[1][0].(string))
+	}
+	projects, err = cat.OpenTable("projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = projects.Select(false, "owner")
+	if err != nil {
+		t.Error("failure select")
+	}
+	if len(res[0]) != 3 {
+		t.Errorf("expected: 3 rows, actual: %d", len(res[0]))
+	}
+
+	if err := cat.DropTable("users"); err != nil {
+		t.Error(err)
+	}
+	if _, err := cat.OpenTable("users"); err != storage.ErrTableNotFound {
+		t.Errorf("expected ErrTableNotFound, actual: %v", err)
+	}
+	tables := cat.Tables()
+	if len(tables) != 1 || tables[0] != "projects" {
+		t.Errorf("expected: [projects], actual: %v", tables)
+	}
+}
+
+func TestCatalogLongColumnName(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	cat := storage.NewCatalog(fm, ptb)
+	st, _ := cat.CreateTable("events")
+	st.AddColumn("event_id", storage.IntergerType)
+	st.AddColumn("occurred_at", storage.IntergerType)
+	st.Add(1, 1620000000)
+	cat.Flush()
+
+	cat = storage.NewCatalogFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st, _ = cat.OpenTable("events")
+	res, err := st.Select(false, "occurred_at")
+	if err != nil {
+		t.Error("failure select")
+	}
+	if len(res) != 1 || res[0][0].(int32) != 1620000000 {
+		t.Errorf("expected: 1620000000, actual: %v", res)
+	}
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	cat := storage.NewCatalog(fm, ptb)
+	users, _ := cat.CreateTable("users")
+	users.AddColumn("id", storage.IntergerType)
+	users.AddColumn("email", storage.VarcharType(32))
+	users.AddColumn("age", storage.IntergerType)
+	for _, i := range rand.Perm(30) {
+		users.Add(i, fmt.Sprintf("user%d@example.com", i), i%3)
+	}
+	if err := cat.CreateIndex("users", []string{"email"}, true); err != nil {
+		t.Fatal(err)
+	}
+	// 重複があるとunique indexは作れない
+	if err := cat.CreateIndex("users", []string{"age"}, true); err != storage.ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, actual: %v", err)
+	}
+	if err := cat.CreateIndex("users", []string{"age"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.CreateIndex("users", []string{"age"}, false); err != storage.ErrIndexExists {
+		t.Errorf("expected ErrIndexExists, actual: %v", err)
+	}
+	users.AddColumn("nickname", storage.VarcharType(16))
+
+	res, err := users.Lookup([]string{"email"}, "user7@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0][0].(int32) != 7 {
+		t.Errorf("unexpected lookup result: %v", res)
+	}
+	res, _ = users.Lookup([]string{"age"}, 1)
+	if len(res) != 10 {
+		t.Errorf("expected: 10 rows, actual: %d", len(res))
+	}
+	for i, row := range res {
+		if row[0].(int32) != int32(3*i+1) {
+			t.Errorf("unexpected row: %v", row)
+		}
+	}
+	if _, err := users.Lookup([]string{"id", "age"}, 1, 1); err != storage.ErrIndexNotFound {
+		t.Errorf("expected ErrIndexNotFound, actual: %v", err)
+	}
+
+	if err := users.Add(100, "user7@example.com", 0, nil); err != storage.ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, actual: %v", err)
+	}
+	users.Update(7, "email", "seven@example.com")
+	users.Upsert(8, "eight@example.com", 2, "eight")
+	users.Delete(1)
+	users.Add(30, "user1@example.com", 1, nil)
+	cat.Flush()
+
+	cat = storage.NewCatalogFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	users, _ = cat.OpenTable("users")
+	for email, expected := range map[string]int32{"seven@example.com": 7, "eight@example.com": 8, "user1@example.com": 30} {
+		res, _ = users.Lookup([]string{"email"}, email)
+		if len(res) != 1 || res[0][0].(int32) != expected {
+			t.Errorf("%s: unexpected lookup result: %v", email, res)
+		}
+	}
+	for _, email := range []string{"user7@example.com", "user8@example.com"} {
+		if res, _ = users.Lookup([]string{"email"}, email); len(res) != 0 {
+			t.Errorf("%s: stale index entry: %v", email, res)
+		}
+	}
+
+	rows, err := users.Rows(storage.And(storage.Eq("age", 2), storage.Lt("id", 10)), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	if fmt.Sprint(ids) != "[2 5 8]" {
+		t.Errorf("expected: [2 5 8], actual: %v", ids)
+	}
+	if err := users.DropColumn("email"); err != storage.ErrIndexedColumn {
+		t.Errorf("expected ErrIndexedColumn, actual: %v", err)
+	}
+}
+
+func TestFailedIndexFreesPages(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	cat := storage.NewCatalog(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st, _ := cat.CreateTable("codes")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("code", storage.VarcharType(32))
+	// 最後のレコードで重複が見つかるので、インデックスはほとんど作られてから失敗する
+	for i := 0; i < 500; i++ {
+		st.Add(i, fmt.Sprintf("code%d", i%499))
+	}
+	var sizes []uint32
+	for n := 0; n < 3; n++ {
+		if err := st.CreateIndex([]string{"code"}, true); err != storage.ErrDuplicateKey {
+			t.Fatalf("expected ErrDuplicateKey, actual: %v", err)
+		}
+		if err := cat.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		size, err := fm.Size(storage.StorageFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, size)
+	}
+	if sizes[1] != sizes[0] || sizes[2] != sizes[0] {
+		t.Errorf("expected pages of failed index to be reused, file sizes: %v", sizes)
+	}
+	if err := st.CreateIndex([]string{"code"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := st.Lookup([]string{"code"}, "code0"); len(res) != 2 {
+		t.Errorf("expected 2 records, actual: %v", res)
+	}
+}
+
+func TestFailedBulkLoadFreesPages(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	cat := storage.NewCatalog(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st, _ := cat.CreateTable("docs")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("code", storage.VarcharType(32))
+	st.AddColumn("body", storage.TextType)
+	if err := st.CreateIndex([]string{"code"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	base, err := fm.Size(storage.StorageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 本文はオーバーフローページに書かれる大きさにする
+	rows := [][]interface{}{}
+	for i := 0; i < 300; i++ {
+		rows = append(rows, []interface{}{i, fmt.Sprintf("code%d", i), strings.Repeat("x", 2000)})
+	}
+	failures := [][]interface{}{
+		{299, "code300", "dup key"},
+		{300, "code0", "dup code"},
+		{nil, "code300", "no key"},
+	}
+	for _, row := range failures {
+		if err := st.BulkLoad(append(rows, row), 1.0); err == nil {
+			t.Fatalf("expected error for %v", row[:2])
+		}
+		if err := cat.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if size, err := fm.Size(storage.StorageFile); err != nil || size != base {
+			t.Errorf("expected failed bulk load to leave file size %d, actual: %d, %v", base, size, err)
+		}
+	}
+	if err := st.BulkLoad(rows, 1.0); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := st.Lookup([]string{"code"}, "code150"); err != nil || len(res) != 1 {
+		t.Errorf("unexpected lookup result: %v, %v", res, err)
+	}
+}
+
+func TestFailedAddFreesPages(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cat := db.Catalog()
+	size := func() int64 {
+		if err := cat.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dir, storage.StorageFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	st, _ := cat.CreateTable("docs")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("code", storage.VarcharType(32))
+	st.AddColumn("body", storage.TextType)
+	st.AddColumn("rev", storage.IntergerType, storage.NotNull)
+	if err := st.CreateIndex([]string{"code"}, true); err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("x", 2000)
+	if err := st.Add(1, "one", body, 1); err != nil {
+		t.Fatal(err)
+	}
+	// 本文を書いた後で失敗しても、オーバーフローページは空きページに戻って次の失敗で再利用される
+	var sizes []int64
+	for i := 0; i < 5; i++ {
+		if err := st.Add(1, "two", body, 1); err != storage.ErrDuplicateKey {
+			t.Fatalf("expected ErrDuplicateKey, actual: %v", err)
+		}
+		if err := st.Add(2, "one", body, 1); err != storage.ErrDuplicateKey {
+			t.Fatalf("expected ErrDuplicateKey, actual: %v", err)
+		}
+		if err := st.Upsert(2, "one", body, 1); err != storage.ErrDuplicateKey {
+			t.Fatalf("expected ErrDuplicateKey, actual: %v", err)
+		}
+		if err := st.Add(2, "two", body, nil); err != storage.ErrNotNull {
+			t.Fatalf("expected ErrNotNull, actual: %v", err)
+		}
+		sizes = append(sizes, size())
+	}
+	for _, actual := range sizes {
+		if actual != sizes[0] {
+			t.Errorf("expected pages of failed adds to be reused, file sizes: %v", sizes)
+			break
+		}
+	}
+	if row, err := st.Get(1); err != nil || row[2] != body {
+		t.Errorf("unexpected row: %v, %v", row, err)
+	}
+}
+
+func TestFreeListWithoutFlush(t *testing.T) {
+	dir := t.TempDir()
+	db1, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+	st, _ := db1.Catalog().CreateTable("docs")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("body", storage.TextType)
+	body := func(i int) string {
+		return strings.Repeat(strconv.Itoa(i), 2000)
+	}
+	for i := 0; i < 4; i++ {
+		st.Add(i, body(i))
+	}
+	for i := 0; i < 4; i++ {
+		st.Delete(i)
+	}
+	if err := db1.Catalog().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 空きページを使った後、ページだけ書き出してFlushせずに落ちたとする
+	for i := 4; i < 6; i++ {
+		if err := st.Add(i, body(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db1.PageTable().Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	st2, err := db2.Catalog().OpenTable("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 6; i < 10; i++ {
+		if err := st2.Add(i, body(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 4; i < 10; i++ {
+		if row, err := st2.Get(i); err != nil || row[1] != body(i) {
+			t.Errorf("unexpected row %d: %v", i, err)
+		}
+	}
+}
+
+func TestFreePages(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	cat := storage.NewCatalog(fm, ptb)
+	fill := func(name string, n int) *storage.Storage {
+		st, err := cat.CreateTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.AddColumn("id", storage.IntergerType)
+		st.AddColumn("body", storage.TextType)
+		for i := 0; i < n; i++ {
+			st.Add(i, strings.Repeat("x", 100*(i%50)))
+		}
+		return st
+	}
+	blocks := func() uint32 {
+		n, err := fm.Size(storage.StorageFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	fill("logs", 300)
+	users := fill("users", 300)
+	cat.Flush()
+	size := blocks()
+
+	// 削除したテーブルのページとオーバーフローページは新しいテーブルで再利用される
+	if err := cat.DropTable("logs"); err != nil {
+		t.Fatal(err)
+	}
+	fill("events", 300)
+	cat.Flush()
+	if actual := blocks(); actual != size {
+		t.Errorf("expected: %d blocks, actual: %d", size, actual)
+	}
+
+	// 末尾の空きページだけがファイルから取り除かれる
+	fill("tail", 300)
+	cat.Flush()
+	grown := blocks()
+	if err := cat.DropTable("tail"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := cat.Vacuum(); err != nil {
+		t.Fatal(err)
+	} else if removed != grown-size {
+		t.Errorf("expected: %d blocks removed, actual: %d", grown-size, removed)
+	}
+	if actual := blocks(); actual != size {
+		t.Errorf("expected: %d blocks, actual: %d", size, actual)
+	}
+
+	// 削除したレコードのオーバーフローページと、併合で空いたページも空きページになる
+	for i := 0; i < 290; i++ {
+		if err := users.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat.Flush()
+
+	cat = storage.NewCatalogFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	fill("tail", 100)
+	for _, name := range []string{"users", "events", "tail"} {
+		st, err := cat.OpenTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := st.Select(false, "id", "body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range res[0] {
+			if res[1][i] != strings.Repeat("x", 100*(int(id.(int32))%50)) {
+				t.Errorf("%s: unexpected body of %d", name, id)
+			}
+		}
+	}
+	if actual := blocks(); actual > size {
+		t.Errorf("expected freed pages to be reused, actual: %d blocks", actual)
+	}
+}
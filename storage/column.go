@@ -4,73 +4,458 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/tychyDB/util"
 )
 
+// idはリネームやバージョンをまたいでカラムを識別する
+// defはカラム追加前のレコードで使う値で、encodeNullableの形で持つ
 type Column struct {
+	id   uint32
 	ty   Type
 	pos  uint32
+	opts ColumnOption
+	def  []byte
 	name string
 }
 
+// ColumnOption is a constraint given to AddColumn.
+type ColumnOption uint32
+
+const (
+	// NotNull rejects nil for the column. Primary key columns are always NOT NULL.
+	NotNull ColumnOption = 1 << iota
+)
+
+var ErrNotNull = errors.New("null value in a NOT NULL column")
+
 func (c Column) String() string {
+	if c.isNotNull() {
+		return fmt.Sprintf("{ type: %s, name: %s, not null }", c.ty, c.name)
+	}
 	return fmt.Sprintf("{ type: %s, name: %s }", c.ty, c.name)
 }
 
+func (c Column) isNotNull() bool {
+	return c.opts&NotNull != 0
+}
+
 func (c Column) Size() uint32 {
 	switch c.ty.id {
 	case integerId:
 		return IntSize
 	case charId:
 		return IntSize + c.ty.size
+	case varcharId, textId, blobId:
+		// {offset, length}
+		return 2 * IntSize
+	case bigintId, booleanId, doubleId, timestampId:
+		return c.ty.size
+	case decimalId:
+		return 8
 	}
 	panic(errors.New("not implemented"))
 }
 
+// 名前の長さは型のサイズとは無関係なので、名前自身の長さで書き込む
 func (c Column) toBytes() []byte {
-	gen := util.NewGenStruct(0, 4*IntSize+c.ty.size)
+	nameLen := uint32(len(c.name))
+	defLen := uint32(len(c.def))
+	gen := util.NewGenStruct(0, 7*IntSize+defLen+nameLen)
+	gen.PutUInt32(c.id)
 	gen.PutUInt32(uint32(c.ty.id))
 	gen.PutUInt32(c.ty.size)
 	gen.PutUInt32(c.pos)
-	gen.PutStringWithSize(c.name, c.ty.size)
+	gen.PutUInt32(uint32(c.opts))
+	gen.PutUInt32(defLen)
+	gen.PutBytes(defLen, c.def)
+	gen.PutStringWithSize(c.name, nameLen)
 	return gen.DumpBytes()
 }
 
 func newColumnfromBytes(bytes []byte) Column {
 	c := Column{}
 	iter := util.NewIterStruct(0, bytes)
+	c.id = iter.NextUInt32()
 	c.ty.id = TypeId(iter.NextUInt32())
 	c.ty.size = iter.NextUInt32()
 	c.pos = iter.NextUInt32()
-	c.name = iter.NextStringWithSize(c.ty.size)
+	c.opts = ColumnOption(iter.NextUInt32())
+	defLen := iter.NextUInt32()
+	c.def = iter.NextBytes(defLen)
+	c.name = iter.NextStringWithSize(uint32(len(bytes)) - 7*IntSize - defLen)
 	return c
 }
 
-func encode(cols []Column, args ...interface{}) (bytes []byte, err error) {
+var (
+	ErrTypeMismatch  = errors.New("the type of a value does not match the column")
+	ErrStringTooLong = errors.New("string too long")
+	// NaNはどの値とも順序がつかず、キーの比較が壊れるので格納しない
+	ErrNaN = errors.New("NaN cannot be stored in a DOUBLE column")
+)
+
+// TIMESTAMPはUnixNanoで持つので、int64に収まる範囲(1677年から2262年)だけを格納できる
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
+)
+
+// レコードは {固定長部分, nullビットマップ, 可変長部分} の順に並ぶ
+// 可変長の値はレコードの後半に置き、固定長部分には {offset, length} のスロットを置く
+// TEXTとBLOBでmaxInlineLenを超えるものはオーバーフローページに置き、先頭ブロック番号だけをレコードに置く
+const maxInlineLen = 128
+
+// overflowWriter stores a large value outside of the page and returns the first block of its chain.
+type overflowWriter func(data []byte) (uint32, error)
+
+// overflowReader reads a value of size bytes from the chain starting at blkNum.
+type overflowReader func(blkNum uint32, size uint32) ([]byte, error)
+
+// field is the stored form of a column in a record.
+// For a variable-length column length is the length of the value, which differs from len(body) when it overflows.
+type field struct {
+	body   []byte
+	length uint32
+	null   bool
+}
+
+func isOverflow(col Column, length uint32) bool {
+	return col.ty.isLarge() && length > maxInlineLen
+}
+
+func fixedSize(cols []Column) uint32 {
+	if len(cols) == 0 {
+		return 0
+	}
+	last := cols[len(cols)-1]
+	return last.pos + last.Size()
+}
+
+func bitmapSize(cols []Column) uint32 {
+	return (uint32(len(cols)) + 7) / 8
+}
+
+func isNullAt(cols []Column, idx int, data []byte) bool {
+	bitmap := data[fixedSize(cols):]
+	return bitmap[idx/8]&(1<<(idx%8)) != 0
+}
+
+func encode(cols []Column, spill overflowWriter, args ...interface{}) (bytes []byte, err error) {
 	if len(args) != len(cols) {
 		err = errors.New("the count of arguments must be same column's")
 		return
 	}
-	bytes = []byte{}
+	fields := make([]field, len(cols))
 	for i, col := range cols {
-		if col.ty.id == integerId {
-			val := uint32(args[i].(int))
-			buf := make([]byte, col.ty.size)
-			binary.BigEndian.PutUint32(buf, val)
-			bytes = append(bytes, buf...)
-		} else if col.ty.id == charId {
-			if len(args[i].(string)) > int(col.ty.size) {
-				panic(errors.New("string too long"))
-			}
-			gen := util.NewGenStruct(0, IntSize+col.ty.size)
-			gen.PutStringWithSize(args[i].(string), col.ty.size)
-			bytes = append(bytes, gen.DumpBytes()...)
-		} else {
-			bytes = nil
-			err = errors.New("the type of a column is not implemented")
-			return
-		}
-	}
-	return
+		buf, err := encodeNullable(col, args[i])
+		if err != nil {
+			return nil, err
+		}
+		if fields[i], err = toField(col, buf, spill); err != nil {
+			return nil, err
+		}
+	}
+	return buildRecord(cols, fields), nil
+}
+
+// encodeNullable is encodeValue accepting nil, which is encoded as an empty slice
+func encodeNullable(col Column, v interface{}) ([]byte, error) {
+	if v == nil {
+		if col.isNotNull() {
+			return nil, ErrNotNull
+		}
+		return []byte{}, nil
+	}
+	return encodeValue(col, v)
+}
+
+func toField(col Column, buf []byte, spill overflowWriter) (field, error) {
+	if len(buf) == 0 {
+		return field{null: true}, nil
+	}
+	if !col.ty.isVariable() {
+		return field{body: buf}, nil
+	}
+	body := buf[IntSize:]
+	length := uint32(len(body))
+	if isOverflow(col, length) {
+		head, err := spill(buf[IntSize:])
+		if err != nil {
+			return field{}, err
+		}
+		body = make([]byte, IntSize)
+		binary.BigEndian.PutUint32(body, head)
+	}
+	return field{body: body, length: length}, nil
+}
+
+func buildRecord(cols []Column, fields []field) []byte {
+	bitmapPos := fixedSize(cols)
+	bytes := make([]byte, bitmapPos+bitmapSize(cols))
+	for i, col := range cols {
+		f := fields[i]
+		if f.null {
+			bytes[bitmapPos+uint32(i/8)] |= 1 << (i % 8)
+			continue
+		}
+		if !col.ty.isVariable() {
+			copy(bytes[col.pos:col.pos+col.Size()], f.body)
+			continue
+		}
+		binary.BigEndian.PutUint32(bytes[col.pos:], uint32(len(bytes)))
+		binary.BigEndian.PutUint32(bytes[col.pos+IntSize:], f.length)
+		bytes = append(bytes, f.body...)
+	}
+	return bytes
+}
+
+func fieldAt(cols []Column, idx int, data []byte) field {
+	col := cols[idx]
+	if isNullAt(cols, idx, data) {
+		return field{null: true}
+	}
+	if !col.ty.isVariable() {
+		return field{body: data[col.pos : col.pos+col.Size()]}
+	}
+	offset := binary.BigEndian.Uint32(data[col.pos:])
+	length := binary.BigEndian.Uint32(data[col.pos+IntSize:])
+	stored := length
+	if isOverflow(col, length) {
+		stored = IntSize
+	}
+	return field{body: data[offset : offset+stored], length: length}
+}
+
+func fieldValue(col Column, f field, load overflowReader) (interface{}, error) {
+	if f.null {
+		return nil, nil
+	}
+	buf, err := fieldBytes(col, f, load)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(col, buf), nil
+}
+
+// fieldBytes returns the value of f encoded in the same way as encodeNullable
+func fieldBytes(col Column, f field, load overflowReader) ([]byte, error) {
+	if f.null {
+		return []byte{}, nil
+	}
+	if !col.ty.isVariable() {
+		buf := make([]byte, len(f.body))
+		copy(buf, f.body)
+		return buf, nil
+	}
+	body := f.body
+	if isOverflow(col, f.length) {
+		var err error
+		if body, err = load(binary.BigEndian.Uint32(body), f.length); err != nil {
+			return nil, err
+		}
+	}
+	return withLength(body), nil
+}
+
+// setColumn returns a copy of the record data whose column idx is replaced by f
+func setColumn(cols []Column, data []byte, idx int, f field) []byte {
+	fields := make([]field, len(cols))
+	for i := range cols {
+		fields[i] = fieldAt(cols, i, data)
+	}
+	fields[idx] = f
+	return buildRecord(cols, fields)
+}
+
+// encodeValue encodes v by itself, as used in keys and update logs.
+// A variable-length value is prefixed by its length.
+func encodeValue(col Column, v interface{}) ([]byte, error) {
+	switch col.ty.id {
+	case integerId:
+		val, ok := toInt64(v)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		if val < math.MinInt32 || val > math.MaxInt32 {
+			return nil, ErrOutOfRange
+		}
+		buf := make([]byte, col.ty.size)
+		binary.BigEndian.PutUint32(buf, uint32(val))
+		return buf, nil
+	case bigintId:
+		val, ok := toInt64(v)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(val))
+		return buf, nil
+	case booleanId:
+		val, ok := v.(bool)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		if val {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case doubleId:
+		var val float64
+		switch x := v.(type) {
+		case float64:
+			val = x
+		case float32:
+			val = float64(x)
+		default:
+			return nil, ErrTypeMismatch
+		}
+		if math.IsNaN(val) {
+			return nil, ErrNaN
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, math.Float64bits(val))
+		return buf, nil
+	case timestampId:
+		val, ok := v.(time.Time)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		if val.Before(minTimestamp) || val.After(maxTimestamp) {
+			return nil, ErrOutOfRange
+		}
+		_, offset := val.Zone()
+		buf := make([]byte, 12)
+		binary.BigEndian.PutUint64(buf, uint64(val.UnixNano()))
+		binary.BigEndian.PutUint32(buf[8:], uint32(int32(offset)))
+		return buf, nil
+	case decimalId:
+		val, err := toDecimal(v, col.ty.size)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(val.Unscaled))
+		return buf, nil
+	case charId:
+		val, ok := v.(string)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		if len(val) > int(col.ty.size) {
+			return nil, ErrStringTooLong
+		}
+		return util.ToByteStringWithSize(val, col.ty.size), nil
+	case varcharId, textId:
+		val, ok := v.(string)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		if col.ty.id == varcharId && len(val) > int(col.ty.size) {
+			return nil, ErrStringTooLong
+		}
+		return withLength([]byte(val)), nil
+	case blobId:
+		val, ok := v.([]byte)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		return withLength(val), nil
+	}
+	return nil, errors.New("the type of a column is not implemented")
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	}
+	return 0, false
+}
+
+// toDecimal accepts a Decimal, a string such as "12.50" or an integer
+func toDecimal(v interface{}, scale uint32) (Decimal, error) {
+	switch x := v.(type) {
+	case Decimal:
+		return x.rescale(scale)
+	case string:
+		d, err := ParseDecimal(x)
+		if err != nil {
+			return Decimal{}, err
+		}
+		return d.rescale(scale)
+	}
+	if n, ok := toInt64(v); ok {
+		return NewDecimal(n, 0).rescale(scale)
+	}
+	return Decimal{}, ErrTypeMismatch
+}
+
+func withLength(body []byte) []byte {
+	buf := make([]byte, IntSize+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[IntSize:], body)
+	return buf
+}
+
+// valueSize returns the length of the value encoded at the head of bytes
+func valueSize(col Column, bytes []byte) uint32 {
+	if !col.ty.isVariable() {
+		return col.Size()
+	}
+	return IntSize + binary.BigEndian.Uint32(bytes)
+}
+
+func decodeValue(col Column, bytes []byte) interface{} {
+	switch col.ty.id {
+	case integerId:
+		return int32(binary.BigEndian.Uint32(bytes))
+	case bigintId:
+		return int64(binary.BigEndian.Uint64(bytes))
+	case booleanId:
+		return bytes[0] != 0
+	case doubleId:
+		return math.Float64frombits(binary.BigEndian.Uint64(bytes))
+	case timestampId:
+		nanos := int64(binary.BigEndian.Uint64(bytes))
+		offset := int32(binary.BigEndian.Uint32(bytes[8:]))
+		loc := time.UTC
+		if offset != 0 {
+			loc = time.FixedZone("", int(offset))
+		}
+		return time.Unix(0, nanos).In(loc)
+	case decimalId:
+		return NewDecimal(int64(binary.BigEndian.Uint64(bytes)), col.ty.size)
+	case charId:
+		return util.ReadStringWithSize(col.ty.size, bytes)
+	case varcharId, textId, blobId:
+		return decodeBody(col, bytes[IntSize:valueSize(col, bytes)])
+	}
+	panic(errors.New("the type of a column is not implemented"))
+}
+
+func decodeBody(col Column, body []byte) interface{} {
+	if col.ty.id == blobId {
+		val := make([]byte, len(body))
+		copy(val, body)
+		return val
+	}
+	return string(body)
+}
+
+func decodeRow(cols []Column, data []byte, load overflowReader) ([]interface{}, error) {
+	row := make([]interface{}, len(cols))
+	for i, col := range cols {
+		val, err := fieldValue(col, fieldAt(cols, i, data), load)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = val
+	}
+	return row, nil
 }
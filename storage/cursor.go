@@ -0,0 +1,277 @@
+package storage
+
+import "sync"
+
+// Cursor walks leaf pages through their sibling links
+// and returns the records whose keys are in [from, to].
+//
+// A cursor returned by Scan or Rows latches the table only while it moves,
+// so the table can be changed between calls of Next.
+// Records added meanwhile may or may not be returned, and the other changes are seen
+// by reading the leaf again from the key of the last record.
+type Cursor struct {
+	st      *Storage
+	bt      *btree
+	cmp     Comparator
+	from    []byte // nilなら下限なし
+	to      []byte // nilなら上限なし
+	reverse bool
+	blkNum  uint32
+	cells   []Cell
+	idx     int
+	cur     KeyValueCell
+	last    []byte // 最後に返したセルのキー
+	started bool
+	err     error
+	latch   *sync.RWMutex // 外部に返すカーソルだけが持つテーブルのラッチ
+	epoch   uint64
+	ring    *bufferRing // 兄弟をたどって読むリーフはリングに読み込む
+}
+
+// Scan returns a cursor over the records whose primary keys are between from and to (both inclusive).
+// A nil bound means that the range is unbounded on that side.
+// When reverse is true the records are returned in descending order.
+func (st *Storage) Scan(from, to interface{}, reverse bool) (*Cursor, error) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	var fromKey, toKey []byte
+	var err error
+	if from != nil {
+		if fromKey, err = st.primaryKey(from); err != nil {
+			return nil, err
+		}
+	}
+	if to != nil {
+		if toKey, err = st.primaryKey(to); err != nil {
+			return nil, err
+		}
+	}
+	cur, err := st.scan(fromKey, toKey, reverse)
+	if err != nil {
+		return nil, err
+	}
+	cur.share()
+	return cur, nil
+}
+
+func (st *Storage) scan(from, to []byte, reverse bool) (*Cursor, error) {
+	bt := st.tree()
+	return newCursor(st, bt, bt.cmp, from, to, reverse)
+}
+
+// newCursor returns a cursor over the cells of bt whose keys are in [from, to] under cmp.
+// cmpがキーの接頭辞だけを比較する場合は、接頭辞が範囲に入るセルを返す
+func newCursor(st *Storage, bt *btree, cmp Comparator, from, to []byte, reverse bool) (*Cursor, error) {
+	cur := &Cursor{st: st, bt: bt, cmp: cmp, from: from, to: to, reverse: reverse, blkNum: NullBlockNum, ring: bt.ptb.newRing()}
+	// 開始位置のリーフまで一度だけ降りる
+	start := cur.from
+	if reverse {
+		start = cur.to
+	}
+	if err := cur.seek(cmp, start); err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// share makes the cursor latch the table by itself, for cursors returned to the caller.
+// Called with the table latched.
+func (cur *Cursor) share() {
+	cur.latch = cur.st.latch
+	cur.epoch = cur.st.epoch
+}
+
+// seek moves the cursor to the first cell not before start under cmp in the direction of the cursor.
+// A nil start means the first leaf.
+func (cur *Cursor) seek(cmp Comparator, start []byte) error {
+	cur.blkNum = NullBlockNum
+	cur.cells = nil
+	cur.started = false
+	if empty, err := cur.bt.isEmpty(); err != nil || empty {
+		return err
+	}
+	var blk BlockId
+	var pg *Page
+	var err error
+	if start == nil {
+		blk, pg, err = cur.bt.edgeLeaf(cur.reverse)
+	} else if cur.reverse {
+		blk, pg, err = cur.bt.upperBound(cmp, start)
+	} else {
+		blk, pg, err = cur.bt.lowerBound(cmp, start)
+	}
+	if err != nil {
+		return err
+	}
+	cur.blkNum = blk.BlockNum
+	cur.load(pg)
+	cur.bt.ptb.unlatch(blk, latchShared)
+	if start != nil {
+		if cur.reverse {
+			for cur.idx >= 0 && cmp(cur.cells[cur.idx].getKey(), start) > 0 {
+				cur.idx--
+			}
+		} else {
+			for cur.idx < len(cur.cells) && cmp(cur.cells[cur.idx].getKey(), start) < 0 {
+				cur.idx++
+			}
+		}
+	}
+	return nil
+}
+
+// load copies the cells of the current leaf so that the page can be evicted while scanning.
+// pg must be latched.
+func (cur *Cursor) load(pg *Page) {
+	cur.cells = pg.entries()
+	if cur.reverse {
+		cur.idx = len(cur.cells) - 1
+	} else {
+		cur.idx = 0
+	}
+}
+
+// sibling returns the block number of the next leaf in the direction of the cursor.
+func (cur *Cursor) sibling(blkNum uint32) (uint32, error) {
+	blk := NewBlockId(blkNum, StorageFile)
+	pg, err := cur.bt.ptb.latchWith(blk, latchShared, cur.ring)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.bt.ptb.unlatch(blk, latchShared)
+	if cur.reverse {
+		return pg.header.prevPtr, nil
+	}
+	return pg.header.nextPtr, nil
+}
+
+// advance loads the next leaf in the direction of the cursor.
+// It returns false at the last leaf.
+func (cur *Cursor) advance() (bool, error) {
+	for {
+		next, err := cur.sibling(cur.blkNum)
+		if err != nil {
+			return false, err
+		}
+		if next == NullBlockNum {
+			return false, nil
+		}
+		blk := NewBlockId(next, StorageFile)
+		pg, err := cur.bt.ptb.latchWith(blk, latchShared, cur.ring)
+		if err != nil {
+			return false, err
+		}
+		// リンクを読んでから次のリーフが分割されていたら、左に入ったページを読み飛ばしてしまうので読み直す
+		// 分割では元のページが右に残るので、逆向きではこれは起きない
+		if !cur.reverse && pg.header.prevPtr != cur.blkNum {
+			cur.bt.ptb.unlatch(blk, latchShared)
+			continue
+		}
+		cur.blkNum = next
+		cur.load(pg)
+		cur.bt.ptb.unlatch(blk, latchShared)
+		return true, nil
+	}
+}
+
+// Next advances the cursor to the next record.
+// It returns false at the end of the range or when a page cannot be read, which is reported by Err.
+func (cur *Cursor) Next() bool {
+	if cur.err != nil {
+		return false
+	}
+	if cur.latch != nil {
+		cur.latch.RLock()
+		defer cur.latch.RUnlock()
+		if cur.epoch != cur.st.epoch {
+			// ページが併合や解放されているかもしれないので、最後のキーから探し直す
+			cur.epoch = cur.st.epoch
+			if cur.last != nil && cur.blkNum != NullBlockNum {
+				if err := cur.seek(cur.bt.cmp, cur.last); err != nil {
+					cur.err = err
+					return false
+				}
+			}
+		}
+	}
+	if cur.started {
+		cur.step()
+	}
+	cur.started = true
+	for {
+		if cur.idx < 0 || cur.idx >= len(cur.cells) {
+			if cur.blkNum == NullBlockNum {
+				return false
+			}
+			ok, err := cur.advance()
+			if err != nil {
+				cur.err = err
+				return false
+			}
+			if !ok {
+				cur.blkNum = NullBlockNum
+				cur.cells = nil
+				return false
+			}
+			continue
+		}
+		// 読み直したリーフには返したセルが含まれることがある
+		if cur.last != nil && cur.passed(cur.cells[cur.idx].getKey()) {
+			cur.step()
+			continue
+		}
+		break
+	}
+
+	cell := cur.cells[cur.idx].(KeyValueCell)
+	if cur.reverse && cur.from != nil && cur.cmp(cell.key, cur.from) < 0 {
+		cur.blkNum = NullBlockNum
+		cur.cells = nil
+		return false
+	}
+	if !cur.reverse && cur.to != nil && cur.cmp(cell.key, cur.to) > 0 {
+		cur.blkNum = NullBlockNum
+		cur.cells = nil
+		return false
+	}
+	cur.cur = cell
+	cur.last = cell.key
+	return true
+}
+
+func (cur *Cursor) step() {
+	if cur.reverse {
+		cur.idx--
+	} else {
+		cur.idx++
+	}
+}
+
+// passed reports whether key is at or before the last returned key in the direction of the cursor.
+func (cur *Cursor) passed(key []byte) bool {
+	c := cur.bt.cmp(key, cur.last)
+	if cur.reverse {
+		return c >= 0
+	}
+	return c <= 0
+}
+
+// Values returns the record at the cursor decoded with the columns of the table.
+// If the record cannot be read, it returns nil and the error is reported by Err.
+func (cur *Cursor) Values() []interface{} {
+	if cur.latch != nil {
+		cur.latch.RLock()
+		defer cur.latch.RUnlock()
+	}
+	row, err := cur.st.decodeRecord(cur.cur.rec)
+	if err != nil {
+		cur.err = err
+		return nil
+	}
+	return row
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (cur *Cursor) Err() error {
+	return cur.err
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tychyDB/util"
+)
+
+// FormatVersion is the version of the layout of storage files written by this package.
+const FormatVersion = 3
+
+// カタログページの先頭に {magicNumber, FormatVersion, ページサイズ} を置く
+const (
+	magicNumber      = 0x74796368 // "tych"
+	formatHeaderSize = 3 * IntSize
+)
+
+const (
+	minPageSize       = 1024
+	maxPageSize       = 65536
+	minBufferPoolSize = 4
+)
+
+var (
+	ErrNotDatabase       = errors.New("not a tychyDB storage file")
+	ErrFormatVersion     = errors.New("unsupported storage format version")
+	ErrPageSizeMismatch  = errors.New("page size differs from the one of the database")
+	ErrInvalidPageSize   = errors.New("page size must be a power of two from 1024 to 65536")
+	ErrInvalidBufferPool = errors.New("buffer pool must hold at least 4 pages")
+)
+
+// Options configures the database opened by Open.
+type Options struct {
+	// PageSize is the size of a page of a new database. 0 means PageSize.
+	// An existing database is opened with the page size it was created with.
+	PageSize uint32
+	// BufferPoolSize is the number of pages kept in memory. 0 means MaxBufferPoolSize.
+	BufferPoolSize int
+	// WaitTimeout is how long reading a page waits for a page to be unpinned when the buffer pool is full.
+	// 0 means DefaultWaitTimeout.
+	WaitTimeout time.Duration
+	// Replacement decides which page is evicted from the full buffer pool. The zero value is ClockReplacement.
+	Replacement ReplacementPolicy
+	// LogDir is the directory of the log file. An empty string means the "log" directory in the database directory.
+	LogDir string
+	// Sync decides when commits are synced to the log file. The zero value syncs on every commit.
+	Sync SyncOptions
+}
+
+// DB is a database stored in a directory.
+type DB struct {
+	fm    *FileMgr
+	logFm *FileMgr
+	ptb   *PageTable
+	cat   *Catalog
+}
+
+// Open opens the database in the directory path, creating it if it doesn't exist.
+func Open(path string, opts Options) (*DB, error) {
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = PageSize
+	}
+	if !validPageSize(pageSize) {
+		return nil, ErrInvalidPageSize
+	}
+	poolSize := opts.BufferPoolSize
+	if poolSize == 0 {
+		poolSize = MaxBufferPoolSize
+	}
+	if poolSize < minBufferPoolSize {
+		return nil, ErrInvalidBufferPool
+	}
+	if _, err := newReplacer(opts.Replacement, poolSize); err != nil {
+		return nil, err
+	}
+	logDir := opts.LogDir
+	if logDir == "" {
+		logDir = filepath.Join(path, "log")
+	}
+	for _, dir := range []string{path, logDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	db := &DB{}
+	db.fm = newFileMgr(path, pageSize)
+	_, err := os.Stat(db.fm.path(StorageFile))
+	exists := err == nil
+	if exists {
+		// 既存のデータベースは作成時のページサイズで開く
+		size, err := readFormat(db.fm)
+		if err == nil && opts.PageSize != 0 && opts.PageSize != size {
+			err = ErrPageSizeMismatch
+		}
+		if err != nil {
+			db.fm.Close()
+			return nil, err
+		}
+		pageSize = size
+		db.fm.blockSize = int64(size)
+	}
+	db.logFm = newFileMgr(logDir, pageSize)
+	db.logFm.syncOpts = opts.Sync
+	db.ptb, _ = newPageTable(newBufferMgr(db.fm, poolSize), opts.Replacement)
+	if opts.WaitTimeout > 0 {
+		db.ptb.SetWaitTimeout(opts.WaitTimeout)
+	}
+	if exists {
+		db.cat, err = openCatalog(db.fm, db.ptb)
+	} else {
+		db.cat, err = newCatalog(db.fm, db.ptb)
+	}
+	if err != nil {
+		db.fm.Close()
+		db.logFm.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// readFormat validates the header of the catalog page and returns the page size of the file.
+func readFormat(fm *FileMgr) (uint32, error) {
+	n, bytes, err := fm.Read(NewBlockId(0, StorageFile))
+	if err != nil {
+		return 0, err
+	}
+	if n < formatHeaderSize {
+		return 0, ErrNotDatabase
+	}
+	iter := util.NewIterStruct(0, bytes)
+	if iter.NextUInt32() != magicNumber {
+		return 0, ErrNotDatabase
+	}
+	if iter.NextUInt32() != FormatVersion {
+		return 0, ErrFormatVersion
+	}
+	pageSize := iter.NextUInt32()
+	if !validPageSize(pageSize) {
+		return 0, ErrNotDatabase
+	}
+	return pageSize, nil
+}
+
+func validPageSize(pageSize uint32) bool {
+	return pageSize >= minPageSize && pageSize <= maxPageSize && pageSize&(pageSize-1) == 0
+}
+
+func (db *DB) Catalog() *Catalog {
+	return db.cat
+}
+
+func (db *DB) PageTable() *PageTable {
+	return db.ptb
+}
+
+// LogFileMgr returns the FileMgr of the log directory.
+func (db *DB) LogFileMgr() *FileMgr {
+	return db.logFm
+}
+
+// Close writes all the pages in the buffer pool and the catalog back to the file and closes the files.
+func (db *DB) Close() error {
+	err := db.cat.Flush()
+	if cerr := db.fm.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := db.logFm.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,682 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tychyDB/storage"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{PageSize: 1024, BufferPoolSize: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := db.Catalog().CreateTable("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("title", storage.VarcharType(200))
+	st.AddColumn("body", storage.TextType)
+	for i := 0; i < 500; i++ {
+		if err := st.Add(i, strings.Repeat("t", i%200), strings.Repeat("b", i*7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "log")); err != nil || !info.IsDir() {
+		t.Errorf("expected log directory, actual: %v", err)
+	}
+
+	// 既存のデータベースは作成時のページサイズで開かれる
+	db, err = storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := db.LogFileMgr().PageSize(); size != 1024 {
+		t.Errorf("expected: 1024, actual: %d", size)
+	}
+	st, _ = db.Catalog().OpenTable("notes")
+	res, err := st.Select(false, "id", "title", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0]) != 500 {
+		t.Fatalf("expected: 500 rows, actual: %d", len(res[0]))
+	}
+	for i, id := range res[0] {
+		n := int(id.(int32))
+		if res[1][i] != strings.Repeat("t", n%200) || res[2][i] != strings.Repeat("b", n*7) {
+			t.Errorf("unexpected record %d", n)
+		}
+	}
+	if _, err := storage.Open(dir, storage.Options{PageSize: 4096}); err != storage.ErrPageSizeMismatch {
+		t.Errorf("expected ErrPageSizeMismatch, actual: %v", err)
+	}
+
+	if _, err := storage.Open(t.TempDir(), storage.Options{PageSize: 1000}); err != storage.ErrInvalidPageSize {
+		t.Errorf("expected ErrInvalidPageSize, actual: %v", err)
+	}
+	if _, err := storage.Open(t.TempDir(), storage.Options{BufferPoolSize: 2}); err != storage.ErrInvalidBufferPool {
+		t.Errorf("expected ErrInvalidBufferPool, actual: %v", err)
+	}
+	logDir := filepath.Join(t.TempDir(), "wal")
+	if _, err := storage.Open(t.TempDir(), storage.Options{LogDir: logDir}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(logDir); err != nil {
+		t.Errorf("expected log directory, actual: %v", err)
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, storage.StorageFile), []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Open(dir, storage.Options{}); err != storage.ErrNotDatabase {
+		t.Errorf("expected ErrNotDatabase, actual: %v", err)
+	}
+
+	dir = t.TempDir()
+	db, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	path := filepath.Join(dir, storage.StorageFile)
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(bytes[storage.IntSize:], storage.FormatVersion+1)
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Open(dir, storage.Options{}); err != storage.ErrFormatVersion {
+		t.Errorf("expected ErrFormatVersion, actual: %v", err)
+	}
+
+	// 記録されたページサイズが壊れていたら開かない
+	binary.BigEndian.PutUint32(bytes[storage.IntSize:], storage.FormatVersion)
+	for _, pageSize := range []uint32{0, 512, 1 << 17, 3000} {
+		binary.BigEndian.PutUint32(bytes[2*storage.IntSize:], pageSize)
+		if err := os.WriteFile(path, bytes, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Open(dir, storage.Options{}); err != storage.ErrNotDatabase {
+			t.Errorf("page size %d: expected ErrNotDatabase, actual: %v", pageSize, err)
+		}
+	}
+}
+
+func TestOpenIOError(t *testing.T) {
+	dir := t.TempDir()
+	// ストレージファイルの場所にディレクトリがあると開けない
+	if err := os.Mkdir(filepath.Join(dir, storage.StorageFile), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Open(dir, storage.Options{}); !errors.Is(err, storage.ErrFileOpen) {
+		t.Errorf("expected ErrFileOpen, actual: %v", err)
+	}
+}
+
+func TestCorruptPage(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := db.Catalog().CreateTable("users")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("name", storage.VarcharType(16))
+	st.AddColumn("bio", storage.TextType)
+	st.Add(1, "tychy", strings.Repeat("a", 2000))
+	st.Add(2, "tmp", strings.Repeat("b", 300))
+	if err := st.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ブロック0はカタログ、1はメタページ、2はroot、3と4はオーバーフロー、5はリーフ、6は空きページ
+	path := filepath.Join(dir, storage.StorageFile)
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		blk int
+		run func(db *storage.DB) error
+	}{
+		{0, nil},
+		{1, func(db *storage.DB) error {
+			_, err := db.Catalog().OpenTable("users")
+			return err
+		}},
+		{4, func(db *storage.DB) error {
+			st, _ := db.Catalog().OpenTable("users")
+			_, err := st.Get(1)
+			return err
+		}},
+		{5, func(db *storage.DB) error {
+			st, _ := db.Catalog().OpenTable("users")
+			_, err := st.Get(1)
+			return err
+		}},
+		{6, func(db *storage.DB) error {
+			st, _ := db.Catalog().OpenTable("users")
+			return st.Add(3, "new", strings.Repeat("c", 300))
+		}},
+	}
+	for _, c := range cases {
+		bytes := append([]byte{}, orig...)
+		bytes[(c.blk+1)*1024-100] ^= 0xff
+		if err := os.WriteFile(path, bytes, 0644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := storage.Open(dir, storage.Options{})
+		if c.run == nil {
+			if !errors.Is(err, storage.ErrCorruptPage) {
+				t.Errorf("block %d: expected ErrCorruptPage, actual: %v", c.blk, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.run(db); !errors.Is(err, storage.ErrCorruptPage) {
+			t.Errorf("block %d: expected ErrCorruptPage, actual: %v", c.blk, err)
+		}
+		db.Close()
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	open := func(opts storage.SyncOptions) (*storage.DB, *storage.FileMgr, *storage.Syncer) {
+		db, err := storage.Open(t.TempDir(), storage.Options{Sync: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm := db.LogFileMgr()
+		return db, fm, fm.NewSyncer("log")
+	}
+	// 並行にコミットしてエラーを集める
+	commitAll := func(fm *storage.FileMgr, s *storage.Syncer, n int) {
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := fm.Write(storage.NewBlockId(uint32(i), "log"), []byte("commit")); err != nil {
+					errs <- err
+					return
+				}
+				errs <- s.Commit()
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// コミットのたびに同期する
+	db, fm, s := open(storage.SyncOptions{Policy: storage.SyncPerCommit})
+	for i := 0; i < 5; i++ {
+		fm.Write(storage.NewBlockId(uint32(i), "log"), []byte("commit"))
+		if err := s.Commit(); err != nil {
+			t.Error(err)
+		}
+		if syncs := s.Syncs(); syncs != uint64(i+1) {
+			t.Errorf("per commit: expected %d syncs, actual: %d", i+1, syncs)
+		}
+	}
+	s.Close()
+	db.Close()
+
+	// グループのコミットが揃うまで同期されず、揃ったら1回で同期される
+	db, fm, s = open(storage.SyncOptions{Policy: storage.SyncGroup, GroupSize: 4, Interval: time.Hour})
+	commitAll(fm, s, 8)
+	if syncs := s.Syncs(); syncs != 2 {
+		t.Errorf("group: expected 2 syncs for 8 commits, actual: %d", syncs)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	db.Close()
+
+	// 揃わなくてもIntervalが過ぎれば同期される
+	db, fm, s = open(storage.SyncOptions{Policy: storage.SyncGroup, GroupSize: 100, Interval: 50 * time.Millisecond})
+	commitAll(fm, s, 10)
+	if syncs := s.Syncs(); syncs == 0 || syncs >= 10 {
+		t.Errorf("group: expected 1 to 9 syncs for 10 commits, actual: %d", syncs)
+	}
+	s.Close()
+	db.Close()
+
+	// コミットは待たずに、バックグラウンドでまとめて同期される
+	db, fm, s = open(storage.SyncOptions{Policy: storage.SyncPeriodic, Interval: 20 * time.Millisecond})
+	for i := 0; i < 50; i++ {
+		fm.Write(storage.NewBlockId(uint32(i), "log"), []byte("commit"))
+		if err := s.Commit(); err != nil {
+			t.Error(err)
+		}
+	}
+	if syncs := s.Syncs(); syncs >= 50 {
+		t.Errorf("periodic: expected fewer syncs than commits, actual: %d", syncs)
+	}
+	for deadline := time.Now().Add(time.Second); s.Syncs() == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if syncs := s.Syncs(); syncs == 0 || syncs > 2 {
+		t.Errorf("periodic: expected 1 or 2 background syncs, actual: %d", syncs)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	db.Close()
+}
+
+func TestWaitForUnpin(t *testing.T) {
+	db, err := storage.Open(t.TempDir(), storage.Options{PageSize: 1024, BufferPoolSize: 4, WaitTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, _ := db.Catalog().CreateTable("nums")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("num", storage.IntergerType)
+	for i := 0; i < 500; i++ {
+		st.Add(i, i)
+	}
+
+	// ブロック2以降は木のページ
+	ptb := db.PageTable()
+	for i := 2; i < 6; i++ {
+		if err := ptb.Pin(storage.NewBlockId(uint32(i), storage.StorageFile)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error)
+	go func() {
+		done <- ptb.Pin(storage.NewBlockId(6, storage.StorageFile))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ptb.Unpin(storage.NewBlockId(2, storage.StorageFile))
+	if err := <-done; err != nil {
+		t.Errorf("expected pin after unpin, actual: %v", err)
+	}
+
+	// 全部pinされたままならタイムアウトする
+	if err := ptb.Pin(storage.NewBlockId(7, storage.StorageFile)); !errors.Is(err, storage.ErrBufferPoolFull) {
+		t.Errorf("expected ErrBufferPoolFull, actual: %v", err)
+	}
+	for i := 3; i < 7; i++ {
+		ptb.Unpin(storage.NewBlockId(uint32(i), storage.StorageFile))
+	}
+	if _, err := st.Get(1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPinCount(t *testing.T) {
+	db, err := storage.Open(t.TempDir(), storage.Options{PageSize: 1024, BufferPoolSize: 4, WaitTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, _ := db.Catalog().CreateTable("nums")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("num", storage.IntergerType)
+	for i := 0; i < 500; i++ {
+		st.Add(i, i)
+	}
+
+	// 2回pinしたページは1回のunpinでは追い出されない
+	ptb := db.PageTable()
+	blk := func(i int) storage.BlockId {
+		return storage.NewBlockId(uint32(i), storage.StorageFile)
+	}
+	ptb.Pin(blk(2))
+	ptb.Pin(blk(2))
+	ptb.Unpin(blk(2))
+	for i := 3; i < 6; i++ {
+		if err := ptb.Pin(blk(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ptb.Pin(blk(6)); !errors.Is(err, storage.ErrBufferPoolFull) {
+		t.Errorf("expected ErrBufferPoolFull, actual: %v", err)
+	}
+	ptb.Unpin(blk(2))
+	if err := ptb.Pin(blk(6)); err != nil {
+		t.Error(err)
+	}
+	for i := 3; i < 7; i++ {
+		ptb.Unpin(blk(i))
+	}
+}
+
+func TestWriteBackDirtyPage(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, _ := db.Catalog().CreateTable("users")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("name", storage.VarcharType(16))
+	st.Add(1, "tychy")
+	if err := db.PageTable().Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ブロック3はリーフ。バッファに載せた後でファイルの方を書き換え、書き戻されたかを見る
+	f, err := os.OpenFile(filepath.Join(dir, storage.StorageFile), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	leaf := make([]byte, 1024)
+	f.ReadAt(leaf, 3*1024)
+	garbage := []byte("garbage")
+	writtenBack := func() bool {
+		buf := make([]byte, len(garbage))
+		f.ReadAt(buf, 3*1024)
+		return string(buf) != string(garbage)
+	}
+
+	// 読んだだけのページは書き戻されない
+	if _, err := st.Get(1); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(garbage, 3*1024)
+	if err := db.PageTable().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writtenBack() {
+		t.Errorf("clean page was written back")
+	}
+
+	// 変更したページは書き戻される
+	f.WriteAt(leaf, 3*1024)
+	if _, err := st.Get(1); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(garbage, 3*1024)
+	st.Update(1, "name", "tyc")
+	if err := db.PageTable().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !writtenBack() {
+		t.Errorf("dirty page was not written back")
+	}
+	rec, err := st.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec[1] != "tyc" {
+		t.Errorf("expected tyc, actual: %v", rec[1])
+	}
+}
+
+func TestReplacementPolicy(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := db.Catalog().CreateTable("nums")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("num", storage.IntergerType)
+	for i := 0; i < 1000; i++ {
+		st.Add(i, i)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Open(dir, storage.Options{Replacement: 100}); err != storage.ErrInvalidReplacement {
+		t.Errorf("expected ErrInvalidReplacement, actual: %v", err)
+	}
+
+	// 2回使ったページの後にスキャンが来ても、LRU-Kと2Qではページが残る
+	blk := func(i int) storage.BlockId {
+		return storage.NewBlockId(uint32(i), storage.StorageFile)
+	}
+	accesses := []int{2, 2, 3, 4, 5, 6, 2, 7, 8, 9, 10, 11, 12}
+	for _, tc := range []struct {
+		policy storage.ReplacementPolicy
+		hit    bool
+	}{
+		{storage.ClockReplacement, false},
+		{storage.LRUReplacement, false},
+		{storage.LRUKReplacement, true},
+		{storage.TwoQReplacement, true},
+	} {
+		db, err := storage.Open(dir, storage.Options{BufferPoolSize: 4, Replacement: tc.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptb := db.PageTable()
+		if ptb.Policy() != tc.policy {
+			t.Errorf("expected %v, actual: %v", tc.policy, ptb.Policy())
+		}
+		ptb.Flush()
+		for _, i := range accesses {
+			if err := ptb.Pin(blk(i)); err != nil {
+				t.Fatal(err)
+			}
+			ptb.Unpin(blk(i))
+		}
+		before := ptb.Stats()
+		if before.Misses == 0 || before.Hits == 0 || before.Evictions == 0 {
+			t.Errorf("%v: unexpected stats: %v", tc.policy, before)
+		}
+		ptb.Pin(blk(2))
+		ptb.Unpin(blk(2))
+		if hit := ptb.Stats().Hits > before.Hits; hit != tc.hit {
+			t.Errorf("%v: expected hit %v, actual: %v", tc.policy, tc.hit, hit)
+		}
+
+		// どの方式でも読み書きできる
+		st, _ := db.Catalog().OpenTable("nums")
+		for i := 0; i < 1000; i += 37 {
+			rec, err := st.Get(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec[1] != int32(i) {
+				t.Errorf("%v: expected %d, actual: %v", tc.policy, i, rec[1])
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	db, err := storage.Open(t.TempDir(), storage.Options{PageSize: 1024, BufferPoolSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, _ := db.Catalog().CreateTable("nums")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("num", storage.IntergerType)
+	for i := 0; i < 300; i++ {
+		st.Add(i, i)
+	}
+
+	const writers, perWriter = 4, 200
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				id := 1000 + i*writers + w
+				if err := st.Add(id, id); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	// 既存のレコードの一部は消す
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 300; i += 3 {
+			if err := st.Delete(i); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i < 300; i += 3 {
+				if row, err := st.Get(i); err != nil || row[1] != int32(i) {
+					errs <- fmt.Errorf("get %d: %v %v", i, row, err)
+					return
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 3; n++ {
+				rows, err := st.Rows(nil, "id")
+				if err != nil {
+					errs <- err
+					return
+				}
+				prev := int32(-1)
+				for rows.Next() {
+					id := rows.Values()[0].(int32)
+					if id <= prev {
+						errs <- fmt.Errorf("rows out of order: %d after %d", id, prev)
+						return
+					}
+					prev = id
+				}
+				if err := rows.Err(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	res, err := st.Select(false, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 200 + writers*perWriter; len(res[0]) != expected {
+		t.Errorf("expected %d records, actual: %d", expected, len(res[0]))
+	}
+	for i := 1000; i < 1000+writers*perWriter; i++ {
+		if _, err := st.Get(i); err != nil {
+			t.Errorf("get %d: %v", i, err)
+		}
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := db.Catalog().CreateTable("nums")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("num", storage.IntergerType)
+	for i := 0; i < 1000; i++ {
+		st.Add(i, i)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const poolSize = 16
+	hot := []int{0, 500, 999}
+	for _, policy := range []storage.ReplacementPolicy{
+		storage.ClockReplacement,
+		storage.LRUReplacement,
+		storage.LRUKReplacement,
+		storage.TwoQReplacement,
+	} {
+		db, err := storage.Open(dir, storage.Options{BufferPoolSize: poolSize, Replacement: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptb := db.PageTable()
+		st, _ := db.Catalog().OpenTable("nums")
+		for n := 0; n < 2; n++ {
+			for _, i := range hot {
+				if _, err := st.Get(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// 全件の走査はバッファプールより多くのページを読む
+		before := ptb.Stats()
+		rows, err := st.Rows(nil, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for rows.Next() {
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1000 {
+			t.Errorf("%v: expected 1000 records, actual: %d", policy, count)
+		}
+		afterScan := ptb.Stats()
+		if afterScan.Misses-before.Misses <= poolSize {
+			t.Errorf("%v: expected scan to read more than %d pages: %v", policy, poolSize, afterScan)
+		}
+
+		// 点検索で使うページは走査の後も残っている
+		for _, i := range hot {
+			if _, err := st.Get(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if after := ptb.Stats(); after.Misses != afterScan.Misses {
+			t.Errorf("%v: expected no miss after scan, actual: %v", policy, after)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var ErrOutOfRange = errors.New("value out of range for the column")
+
+// Decimal is a fixed-point number whose value is Unscaled * 10^-Scale.
+type Decimal struct {
+	Unscaled int64
+	Scale    uint32
+}
+
+func NewDecimal(unscaled int64, scale uint32) Decimal {
+	return Decimal{Unscaled: unscaled, Scale: scale}
+}
+
+// ParseDecimal parses a string such as "-12.50" keeping all the digits after the point.
+func ParseDecimal(s string) (Decimal, error) {
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	digits := intPart + fracPart
+	if digits == "" || len(fracPart) > maxDecimalScale {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	var v int64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+		}
+		if v > (math.MaxInt64-int64(c-'0'))/10 {
+			return Decimal{}, ErrOutOfRange
+		}
+		v = v*10 + int64(c-'0')
+	}
+	if neg {
+		v = -v
+	}
+	return Decimal{Unscaled: v, Scale: uint32(len(fracPart))}, nil
+}
+
+// rescale changes the scale of d without losing any digit.
+func (d Decimal) rescale(scale uint32) (Decimal, error) {
+	v := d.Unscaled
+	for s := d.Scale; s < scale; s++ {
+		if v > math.MaxInt64/10 || v < math.MinInt64/10 {
+			return Decimal{}, ErrOutOfRange
+		}
+		v *= 10
+	}
+	for s := d.Scale; s > scale; s-- {
+		if v%10 != 0 {
+			return Decimal{}, ErrOutOfRange
+		}
+		v /= 10
+	}
+	return Decimal{Unscaled: v, Scale: scale}, nil
+}
+
+func (d Decimal) String() string {
+	if d.Scale == 0 {
+		return fmt.Sprint(d.Unscaled)
+	}
+	sign := ""
+	v := uint64(d.Unscaled)
+	if d.Unscaled < 0 {
+		sign = "-"
+		v = uint64(-d.Unscaled)
+	}
+	digits := fmt.Sprintf("%0*d", d.Scale+1, v)
+	point := len(digits) - int(d.Scale)
+	return sign + digits[:point] + "." + digits[point:]
+}
@@ -2,7 +2,11 @@ package storage
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 var (
@@ -13,88 +17,159 @@ var (
 	ErrFileWrite     = errors.New("I/O error while writing file")
 )
 
+// FileMgr reads and writes blocks of the files in a directory.
+// Files are kept open once they are accessed, and it is safe for concurrent use.
 type FileMgr struct {
 	baseDir   string
 	blockSize int64
 	isNew     bool
-	// mu        sync.Mutex
-	// openFiles map[string]*os.File
+	syncOpts  SyncOptions
+	mu        sync.Mutex
+	openFiles map[string]*os.File
 }
 
+// NewFileMgr returns a FileMgr for the directory given by the DISK environment variable.
 func NewFileMgr() *FileMgr {
-	diskDir := os.Getenv("DISK")
+	return newFileMgr(os.Getenv("DISK"), PageSize)
+}
+
+func newFileMgr(baseDir string, blockSize uint32) *FileMgr {
 	fm := &FileMgr{}
-	fm.baseDir = diskDir
-	fm.blockSize = PageSize
+	fm.baseDir = baseDir
+	fm.blockSize = int64(blockSize)
+	fm.openFiles = make(map[string]*os.File)
 	_, err := os.Stat(fm.baseDir)
 	fm.isNew = err != nil
 	if fm.isNew {
-		os.Mkdir(fm.baseDir, 0777)
+		os.MkdirAll(fm.baseDir, 0777)
 	}
 	return fm
 }
 
+// PageSize returns the size of a block in the files.
+func (fm *FileMgr) PageSize() uint32 {
+	return uint32(fm.blockSize)
+}
+
+func (fm *FileMgr) path(fileName string) string {
+	return filepath.Join(fm.baseDir, fileName)
+}
+
+// file returns the handle of fileName, opening the file if it is not open yet.
+func (fm *FileMgr) file(fileName string) (*os.File, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if file, ok := fm.openFiles[fileName]; ok {
+		return file, nil
+	}
+	file, err := os.OpenFile(fm.path(fileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFileOpen, err)
+	}
+	fm.openFiles[fileName] = file
+	return file, nil
+}
+
+// Close closes all the files opened by fm.
+func (fm *FileMgr) Close() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	var res error
+	for name, file := range fm.openFiles {
+		if err := file.Close(); err != nil && res == nil {
+			res = fmt.Errorf("%w: %v", ErrFileWrite, err)
+		}
+		delete(fm.openFiles, name)
+	}
+	return res
+}
+
 func (fm *FileMgr) Clean() {
+	fm.Close()
 	err := os.RemoveAll(fm.baseDir)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func (fm *FileMgr) Write(blk BlockId, bytes []byte) {
-	file, err := os.OpenFile(fm.baseDir+blk.fileName, os.O_WRONLY|os.O_CREATE, 0644)
+func (fm *FileMgr) Write(blk BlockId, bytes []byte) error {
+	file, err := fm.file(blk.fileName)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer file.Close()
+	if _, err := file.WriteAt(bytes, int64(blk.BlockNum)*fm.blockSize); err != nil {
+		return fmt.Errorf("%w: %v", ErrFileWrite, err)
+	}
+	return nil
+}
 
-	_, err = file.Seek(int64(blk.BlockNum)*fm.blockSize, 0)
+// Sync commits the written blocks of fileName to stable storage.
+func (fm *FileMgr) Sync(fileName string) error {
+	file, err := fm.file(fileName)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrFileWrite, err)
 	}
+	return nil
+}
 
-	_, err = file.Write(bytes)
+// Read reads the block blk. It returns the number of bytes read, which is 0 past the end of the file.
+func (fm *FileMgr) Read(blk BlockId) (int, []byte, error) {
+	file, err := fm.file(blk.fileName)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
+	buf := make([]byte, fm.blockSize)
+	n, err := file.ReadAt(buf, int64(blk.BlockNum)*fm.blockSize)
+	if err != nil && err != io.EOF {
+		return 0, nil, fmt.Errorf("%w: %v", ErrFileRead, err)
+	}
+	return n, buf, nil
 }
 
-func (fm *FileMgr) Read(blk BlockId) (int, []byte) {
-	file, err := os.Open(fm.baseDir + blk.fileName)
+// Size returns the number of blocks in the file.
+func (fm *FileMgr) Size(fileName string) (uint32, error) {
+	file, err := fm.file(fileName)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer file.Close()
-	_, err = file.Seek(int64(blk.BlockNum)*fm.blockSize, 0)
-
+	info, err := file.Stat()
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("%w: %v", ErrFileRead, err)
 	}
+	return uint32((info.Size() + fm.blockSize - 1) / fm.blockSize), nil
+}
 
-	buf := make([]byte, PageSize)
-	n, err := file.Read(buf)
-	if n == 0 {
-		return n, buf
-	}
+// Truncate shrinks the file to numOfBlocks blocks.
+func (fm *FileMgr) Truncate(fileName string, numOfBlocks uint32) error {
+	file, err := fm.file(fileName)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := file.Truncate(int64(numOfBlocks) * fm.blockSize); err != nil {
+		return fmt.Errorf("%w: %v", ErrFileWrite, err)
 	}
-	return n, buf
+	return nil
 }
 
-func (fm *FileMgr) ReadLastBlock(fileName string) (int, int, []byte) {
+func (fm *FileMgr) ReadLastBlock(fileName string) (int, int, []byte, error) {
 	curBlkId := 0
-	lastBuf := make([]byte, PageSize)
+	lastBuf := make([]byte, fm.blockSize)
 	lastN := 0
 	for {
-		n, buf := fm.Read(NewBlockId(uint32(curBlkId), fileName))
+		n, buf, err := fm.Read(NewBlockId(uint32(curBlkId), fileName))
+		if err != nil {
+			return 0, 0, nil, err
+		}
 		if n == 0 {
 			if curBlkId == 0 {
-				panic(errors.New("cannot get last block"))
+				return 0, 0, nil, fmt.Errorf("%w: cannot get last block", ErrFileReadShort)
 			}
-			return curBlkId - 1, lastN, lastBuf
-		} else if n != PageSize {
-			return curBlkId, n, buf
+			return curBlkId - 1, lastN, lastBuf, nil
+		} else if int64(n) != fm.blockSize {
+			return curBlkId, n, buf, nil
 		}
 
 		copy(lastBuf, buf)
@@ -1,7 +1,10 @@
 package storage_test
 
 import (
+	"bytes"
+	"errors"
 	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/tychyDB/storage"
@@ -27,7 +30,9 @@ func TestFileMgr(t *testing.T) {
 		curBlk := storage.NewBlockId(uint32(curBlkId), testFName)
 		lower := curBlkId * storage.PageSize
 		upper := min(byteLen, (curBlkId+1)*storage.PageSize)
-		fm.Write(curBlk, token[lower:upper])
+		if err := fm.Write(curBlk, token[lower:upper]); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	for curBlkId := 0; curBlkId < numBlocks; curBlkId++ {
@@ -35,7 +40,10 @@ func TestFileMgr(t *testing.T) {
 		lower := curBlkId * storage.PageSize
 		upper := min(byteLen, (curBlkId+1)*storage.PageSize)
 		buf := token[lower:upper]
-		readLen, readBytes := fm.Read(curBlk)
+		readLen, readBytes, err := fm.Read(curBlk)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		if readLen != len(buf) {
 			t.Error("byte length mismatch")
@@ -60,7 +68,9 @@ func TestFileMgrGetLastBlock(t *testing.T) {
 		curBlk := storage.NewBlockId(uint32(curBlkId), testFName)
 		lower := curBlkId * storage.PageSize
 		upper := min(byteLen, (curBlkId+1)*storage.PageSize)
-		fm.Write(curBlk, token[lower:upper])
+		if err := fm.Write(curBlk, token[lower:upper]); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	curBlkId := numBlocks - 1
@@ -68,7 +78,10 @@ func TestFileMgrGetLastBlock(t *testing.T) {
 	upper := min(byteLen, (curBlkId+1)*storage.PageSize)
 	buf := token[lower:upper]
 
-	blkId, n, lastBytes := fm.ReadLastBlock(testFName)
+	blkId, n, lastBytes, err := fm.ReadLastBlock(testFName)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if blkId != numBlocks-1 {
 		t.Error("block id mismatch")
 	}
@@ -81,3 +94,45 @@ func TestFileMgrGetLastBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestFileMgrConcurrent(t *testing.T) {
+	const concurrentFName = "concurrentFile"
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			blk := storage.NewBlockId(uint32(i), concurrentFName)
+			token := bytes.Repeat([]byte{byte(i)}, storage.PageSize)
+			if err := fm.Write(blk, token); err != nil {
+				errs <- err
+				return
+			}
+			_, buf, err := fm.Read(blk)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(buf, token) {
+				errs <- errors.New("byte mismatch")
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// ファイルの末尾より後ろを読んでもエラーにはならない
+	n, _, err := fm.Read(storage.NewBlockId(64, concurrentFName))
+	if err != nil || n != 0 {
+		t.Errorf("expected: 0 bytes, actual: %d bytes, %v", n, err)
+	}
+	if _, _, _, err := fm.ReadLastBlock("emptyFile"); !errors.Is(err, storage.ErrFileReadShort) {
+		t.Errorf("expected ErrFileReadShort, actual: %v", err)
+	}
+}
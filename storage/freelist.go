@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// allocate returns a block for a new page, reusing a freed block if there is one.
+// 解放されたページは先頭に次の空きブロック番号を持つチェーンになっている
+func (alloc *blockAllocator) allocate() (BlockId, error) {
+	alloc.mu.Lock()
+	defer alloc.mu.Unlock()
+	if alloc.freeHead == NullBlockNum {
+		blk := alloc.newBlock()
+		if err := alloc.persist(); err != nil {
+			alloc.nextBlk--
+			return BlockId{}, err
+		}
+		return blk, nil
+	}
+	blk := NewBlockId(alloc.freeHead, StorageFile)
+	_, bytes, err := alloc.fm.Read(blk)
+	if err != nil {
+		return BlockId{}, err
+	}
+	if err := checkPage(bytes); err != nil {
+		return BlockId{}, err
+	}
+	// ページを使い始める前に、空きリストから外したことを書いておく
+	alloc.freeHead = binary.BigEndian.Uint32(bytes[:IntSize])
+	if err := alloc.persist(); err != nil {
+		alloc.freeHead = blk.BlockNum
+		return BlockId{}, err
+	}
+	return blk, nil
+}
+
+// free puts blk on the free list.
+// The page is dropped from the buffer pool without being written back, so it must not be pinned.
+func (alloc *blockAllocator) free(ptb *PageTable, blk BlockId) error {
+	if blk.BlockNum == 0 {
+		panic(errors.New("cannot free the catalog page"))
+	}
+	alloc.mu.Lock()
+	defer alloc.mu.Unlock()
+	ptb.discard(blk)
+	if err := alloc.writeFreePage(blk, alloc.freeHead); err != nil {
+		return err
+	}
+	prev := alloc.freeHead
+	alloc.freeHead = blk.BlockNum
+	if err := alloc.persist(); err != nil {
+		alloc.freeHead = prev
+		return err
+	}
+	return nil
+}
+
+func (alloc *blockAllocator) writeFreePage(blk BlockId, next uint32) error {
+	buf := make([]byte, alloc.fm.PageSize())
+	binary.BigEndian.PutUint32(buf[:IntSize], next)
+	return alloc.fm.Write(blk, sealPage(buf))
+}
+
+// freeBlocks returns the block numbers on the free list.
+func (alloc *blockAllocator) freeBlocks() ([]uint32, error) {
+	var blks []uint32
+	for cur := alloc.freeHead; cur != NullBlockNum; {
+		blks = append(blks, cur)
+		_, bytes, err := alloc.fm.Read(NewBlockId(cur, StorageFile))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPage(bytes); err != nil {
+			return nil, err
+		}
+		cur = binary.BigEndian.Uint32(bytes[:IntSize])
+	}
+	return blks, nil
+}
+
+// vacuum truncates the free pages at the end of the storage file
+// and returns the number of blocks removed from the file.
+// 残った空きページは番号の小さい順に使われるようにつなぎ直す
+func (alloc *blockAllocator) vacuum() (uint32, error) {
+	alloc.mu.Lock()
+	defer alloc.mu.Unlock()
+	blks, err := alloc.freeBlocks()
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(blks, func(i, j int) bool { return blks[i] < blks[j] })
+	end := alloc.nextBlk
+	for len(blks) > 0 && blks[len(blks)-1] == end-1 {
+		blks = blks[:len(blks)-1]
+		end--
+	}
+	alloc.freeHead = NullBlockNum
+	for i := len(blks) - 1; i >= 0; i-- {
+		if err := alloc.writeFreePage(NewBlockId(blks[i], StorageFile), alloc.freeHead); err != nil {
+			return 0, err
+		}
+		alloc.freeHead = blks[i]
+	}
+	removed := alloc.nextBlk - end
+	alloc.nextBlk = end
+	// 切り詰める前に、末尾のページを指さないカタログを書いておく
+	if err := alloc.persist(); err != nil {
+		return 0, err
+	}
+	if err := alloc.fm.Truncate(StorageFile, end); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// release puts all the pages owned by the table on the free list.
+func (st *Storage) release() error {
+	blks, err := st.tree().pages()
+	if err != nil {
+		return err
+	}
+	ring := st.ptb.newRing()
+	for _, blk := range blks {
+		pg, err := st.ptb.latchWith(blk, latchShared, ring)
+		if err != nil {
+			return err
+		}
+		var entries []Cell
+		if pg.header.isLeaf {
+			entries = pg.entries()
+		}
+		st.ptb.unlatch(blk, latchShared)
+		for _, cell := range entries {
+			rec := cell.(KeyValueCell).rec
+			for _, head := range st.overflowHeads(rec) {
+				chain, err := overflowBlocks(st.fm, head)
+				if err != nil {
+					return err
+				}
+				blks = append(blks, chain...)
+			}
+		}
+	}
+	for i := range st.indexes {
+		pages, err := st.indexTree(i).pages()
+		if err != nil {
+			return err
+		}
+		blks = append(blks, pages...)
+	}
+	blks = append(blks, st.metaBlk)
+	return st.freeBlocks(blks)
+}
+
+// releaseTree puts the pages of bt on the free list. The leaves must not reference overflow pages.
+func (st *Storage) releaseTree(bt *btree) error {
+	blks, err := bt.pages()
+	if err != nil {
+		return err
+	}
+	return st.freeBlocks(blks)
+}
+
+func (st *Storage) freeBlocks(blks []BlockId) error {
+	for _, blk := range blks {
+		if err := st.cat.alloc.free(st.ptb, blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overflowHeads returns the first blocks of the overflow chains referenced by rec.
+func (st *Storage) overflowHeads(rec Record) []uint32 {
+	cols := st.columnsOf(rec.version)
+	var heads []uint32
+	for i, col := range cols {
+		f := fieldAt(cols, i, rec.data)
+		if !f.null && col.ty.isVariable() && isOverflow(col, f.length) {
+			heads = append(heads, binary.BigEndian.Uint32(f.body))
+		}
+	}
+	return heads
+}
+
+// releaseOverflow frees the overflow chains of old except those whose heads are in keep.
+func (st *Storage) releaseOverflow(old Record, keep []uint32) error {
+	for _, head := range st.overflowHeads(old) {
+		kept := false
+		for _, k := range keep {
+			kept = kept || k == head
+		}
+		if kept {
+			continue
+		}
+		if err := st.freeChain(head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abandon frees the overflow chains of rec, which was not written to the table, except those in keep,
+// and returns err.
+func (st *Storage) abandon(rec Record, keep []uint32, err error) error {
+	if ferr := st.releaseOverflow(rec, keep); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// freeChain puts the chain of overflow pages starting at head on the free list.
+func (st *Storage) freeChain(head uint32) error {
+	blks, err := overflowBlocks(st.fm, head)
+	if err != nil {
+		return err
+	}
+	return st.freeBlocks(blks)
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportCSV bulk loads CSV into an empty table.
+// The first line is the header naming the columns. Missing columns and empty fields of
+// non-string columns are NULL.
+func (st *Storage) ImportCSV(r io.Reader, fillFactor float64) error {
+	st.lock()
+	defer st.unlock()
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	idx, err := st.columnIndices(header)
+	if err != nil {
+		return err
+	}
+	var rows [][]interface{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		row := make([]interface{}, len(st.cols))
+		for i, s := range record {
+			col := st.cols[idx[i]]
+			if s == "" && !isStringType(col.ty) {
+				continue
+			}
+			if row[idx[i]], err = parseValue(col, s); err != nil {
+				return fmt.Errorf("line %d: %w", len(rows)+2, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return st.bulkLoad(rows, fillFactor)
+}
+
+// ImportJSONL bulk loads JSON Lines into an empty table.
+// Each line is an object whose keys are column names. Missing keys and null are NULL.
+// TIMESTAMP is written in RFC 3339 and DECIMAL either as a number or a string.
+func (st *Storage) ImportJSONL(r io.Reader, fillFactor float64) error {
+	st.lock()
+	defer st.unlock()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, PageSize), 1<<24)
+	var rows [][]interface{}
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(scanner.Text()))
+		dec.UseNumber()
+		obj := map[string]interface{}{}
+		if err := dec.Decode(&obj); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		row := make([]interface{}, len(st.cols))
+		for name, v := range obj {
+			i := st.columnIndex(name)
+			if i == -1 {
+				return fmt.Errorf("line %d: %w: %s", line, ErrColumnNotFound, name)
+			}
+			val, err := jsonValue(st.cols[i], v)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			row[i] = val
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return st.bulkLoad(rows, fillFactor)
+}
+
+func (st *Storage) columnIndices(names []string) ([]int, error) {
+	idx := make([]int, len(names))
+	for i, name := range names {
+		if idx[i] = st.columnIndex(name); idx[i] == -1 {
+			return nil, fmt.Errorf("%w: %s", ErrColumnNotFound, name)
+		}
+	}
+	return idx, nil
+}
+
+func isStringType(ty Type) bool {
+	return ty.id == charId || ty.id == varcharId || ty.id == textId || ty.id == blobId
+}
+
+// parseValue converts the text representation s into the Go value of the column
+func parseValue(col Column, s string) (interface{}, error) {
+	switch col.ty.id {
+	case integerId, bigintId:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case booleanId:
+		return strconv.ParseBool(s)
+	case doubleId:
+		return strconv.ParseFloat(s, 64)
+	case timestampId:
+		return time.Parse(time.RFC3339Nano, s)
+	case decimalId:
+		return ParseDecimal(s)
+	case blobId:
+		return []byte(s), nil
+	}
+	return s, nil
+}
+
+func jsonValue(col Column, v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		if isStringType(col.ty) {
+			return nil, ErrTypeMismatch
+		}
+		return parseValue(col, x.String())
+	case string:
+		if isStringType(col.ty) || col.ty.id == timestampId || col.ty.id == decimalId {
+			return parseValue(col, x)
+		}
+	case bool:
+		if col.ty.id == booleanId {
+			return x, nil
+		}
+	}
+	return nil, ErrTypeMismatch
+}
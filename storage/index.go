@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrIndexExists   = errors.New("index already exists")
+	ErrIndexNotFound = errors.New("index not found")
+	ErrIndexedColumn = errors.New("cannot drop indexed column")
+)
+
+// セカンダリインデックスのリーフは {インデックスのキー + 主キー} をキーに持ち、レコードは空にする
+// 主キーを含めることで、インデックスのキーが重複してもセルのキーは一意になる
+
+// CreateIndex builds a secondary index on the columns of names.
+// A unique index rejects records having the same values in the columns.
+// Records having NULL in any of the columns are not indexed.
+func (st *Storage) CreateIndex(names []string, unique bool) error {
+	st.lock()
+	defer st.unlock()
+	if len(names) == 0 {
+		return ErrColumnNotFound
+	}
+	ids := make([]uint32, len(names))
+	for i, name := range names {
+		idx := st.columnIndex(name)
+		if idx == -1 {
+			return ErrColumnNotFound
+		}
+		if st.cols[idx].ty.isLarge() {
+			return ErrInvalidKey
+		}
+		ids[i] = st.cols[idx].id
+	}
+	if st.findIndex(ids) != -1 {
+		return ErrIndexExists
+	}
+
+	im := indexMeta{colIds: ids, unique: unique}
+	if err := st.updateMeta(func(pg MetaPage) MetaPage {
+		pg.indexes = append(pg.indexes[:len(pg.indexes):len(pg.indexes)], im)
+		return pg
+	}); err != nil {
+		return err
+	}
+	i := len(st.indexes) - 1
+	// 既存のレコードを登録してから公開する
+	rootBlk, err := newRootPage(st.ptb, st.cat.alloc)
+	if err != nil {
+		st.indexes = st.indexes[:i]
+		return err
+	}
+	st.indexes[i].rootBlk = rootBlk
+	if err := st.buildIndex(i); err != nil {
+		// 途中まで作ったインデックスのページは空きページに戻す
+		if ferr := st.releaseTree(st.indexTree(i)); ferr != nil {
+			err = ferr
+		}
+		st.indexes = st.indexes[:i]
+		return err
+	}
+	return nil
+}
+
+func (st *Storage) buildIndex(i int) error {
+	cur, err := st.scan(nil, nil, false)
+	if err != nil {
+		return err
+	}
+	for cur.Next() {
+		row := cur.Values()
+		if row == nil {
+			break
+		}
+		if err := st.checkIndex(i, row, cur.cur.key); err != nil {
+			return err
+		}
+		if err := st.reindexAt(i, nil, row, cur.cur.key); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Lookup returns the records whose columns of names equal vals using the index on exactly those columns.
+func (st *Storage) Lookup(names []string, vals ...interface{}) ([][]interface{}, error) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	ids := make([]uint32, len(names))
+	for i, name := range names {
+		idx := st.columnIndex(name)
+		if idx == -1 {
+			return nil, ErrColumnNotFound
+		}
+		ids[i] = st.cols[idx].id
+	}
+	i := st.findIndex(ids)
+	if i == -1 {
+		return nil, ErrIndexNotFound
+	}
+	secKey, err := encodeKey(st.indexCols(i), vals)
+	if err != nil {
+		return nil, err
+	}
+	src, err := st.indexScan(i, secKey)
+	if err != nil {
+		return nil, err
+	}
+	res := [][]interface{}{}
+	for src.Next() {
+		res = append(res, src.Values())
+	}
+	if err := src.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (st *Storage) findIndex(ids []uint32) int {
+	for i, im := range st.indexes {
+		if len(im.colIds) != len(ids) {
+			continue
+		}
+		match := true
+		for j, id := range im.colIds {
+			match = match && id == ids[j]
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+func (st *Storage) isIndexedColumn(idx int) bool {
+	for _, im := range st.indexes {
+		for _, id := range im.colIds {
+			if id == st.cols[idx].id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (st *Storage) columnIndexById(id uint32) int {
+	for i, c := range st.cols {
+		if c.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (st *Storage) indexCols(i int) []Column {
+	ids := st.indexes[i].colIds
+	cols := make([]Column, len(ids))
+	for j, id := range ids {
+		cols[j] = st.cols[st.columnIndexById(id)]
+	}
+	return cols
+}
+
+func (st *Storage) indexTree(i int) *btree {
+	cols := append(st.indexCols(i), st.keyCols()...)
+	return &btree{ptb: st.ptb, alloc: st.cat.alloc, root: &st.indexes[i].rootBlk, rootLatch: st.rootLatch, cmp: NewKeyComparator(cols), limit: st.pageLimit()}
+}
+
+// secondaryKey returns the key of row in the index i, or false if row is not indexed.
+func (st *Storage) secondaryKey(i int, row []interface{}) ([]byte, bool) {
+	if row == nil {
+		return nil, false
+	}
+	ids := st.indexes[i].colIds
+	vals := make([]interface{}, len(ids))
+	for j, id := range ids {
+		vals[j] = row[st.columnIndexById(id)]
+		if vals[j] == nil {
+			return nil, false
+		}
+	}
+	key, err := encodeKey(st.indexCols(i), vals)
+	if err != nil {
+		panic(err)
+	}
+	return key, true
+}
+
+// indexScan returns the records whose keys in the index i equal secKey.
+func (st *Storage) indexScan(i int, secKey []byte) (*indexCursor, error) {
+	cmp := NewKeyComparator(st.indexCols(i))
+	cur, err := newCursor(st, st.indexTree(i), cmp, secKey, secKey, false)
+	if err != nil {
+		return nil, err
+	}
+	return &indexCursor{st: st, cur: cur, prefixLen: len(secKey)}, nil
+}
+
+// checkIndexes reports an error if row of the primary key pk cannot be put in an index.
+func (st *Storage) checkIndexes(row []interface{}, pk []byte) error {
+	for i := range st.indexes {
+		if err := st.checkIndex(i, row, pk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *Storage) checkIndex(i int, row []interface{}, pk []byte) error {
+	secKey, ok := st.secondaryKey(i, row)
+	if !ok {
+		return nil
+	}
+	if uint32(len(secKey)+len(pk)) > maxKeySize(st.fm.PageSize()) {
+		return ErrKeyTooLarge
+	}
+	if !st.indexes[i].unique {
+		return nil
+	}
+	src, err := st.indexScan(i, secKey)
+	if err != nil {
+		return err
+	}
+	for src.cur.Next() {
+		if !bytes.Equal(src.primaryKey(), pk) {
+			return ErrDuplicateKey
+		}
+	}
+	return src.cur.Err()
+}
+
+// reindex replaces the index entries of old with the ones of row.
+// A nil old or row means that the record is inserted or deleted.
+func (st *Storage) reindex(old, row []interface{}, pk []byte) error {
+	for i := range st.indexes {
+		if err := st.reindexAt(i, old, row, pk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *Storage) reindexAt(i int, old, row []interface{}, pk []byte) error {
+	oldKey, hasOld := st.secondaryKey(i, old)
+	newKey, hasNew := st.secondaryKey(i, row)
+	if hasOld && hasNew && bytes.Equal(oldKey, newKey) {
+		return nil
+	}
+	bt := st.indexTree(i)
+	if hasOld {
+		if err := bt.delete(append(oldKey, pk...)); err != nil {
+			return err
+		}
+	}
+	if hasNew {
+		if err := bt.insert(KeyValueCell{key: append(newKey, pk...)}, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexUpdate checks that the indexes accept the record of cell replaced by newCell,
+// and returns the old and new rows to be passed to reindex after the record is replaced.
+func (st *Storage) indexUpdate(cell, newCell KeyValueCell) (old, row []interface{}, err error) {
+	if len(st.indexes) == 0 {
+		return nil, nil, nil
+	}
+	if old, err = st.decodeRecord(cell.rec); err != nil {
+		return nil, nil, err
+	}
+	if row, err = st.decodeRecord(newCell.rec); err != nil {
+		return nil, nil, err
+	}
+	if err := st.checkIndexes(row, cell.key); err != nil {
+		return nil, nil, err
+	}
+	return old, row, nil
+}
+
+// indexSource returns the records matching an equality condition of pred through an index,
+// or nil if no index is usable. The records still have to be filtered by pred.
+func (st *Storage) indexSource(pred Predicate) (*indexCursor, error) {
+	var conds []comparison
+	switch p := pred.(type) {
+	case comparison:
+		conds = append(conds, p)
+	case and:
+		for _, q := range p {
+			if c, ok := q.(comparison); ok {
+				conds = append(conds, c)
+			}
+		}
+	}
+	for _, c := range conds {
+		idx := st.columnIndex(c.name)
+		if c.op != opEq || idx == -1 {
+			continue
+		}
+		i := st.findIndex([]uint32{st.cols[idx].id})
+		if i == -1 {
+			continue
+		}
+		secKey, err := encodeKey(st.indexCols(i), []interface{}{c.val})
+		if err != nil {
+			continue
+		}
+		return st.indexScan(i, secKey)
+	}
+	return nil, nil
+}
+
+// indexCursor walks an index and returns the records of the primary keys found in it.
+type indexCursor struct {
+	st        *Storage
+	cur       *Cursor
+	prefixLen int
+	row       []interface{}
+	err       error
+	latch     *sync.RWMutex // Rowsに返すときだけ持つ
+}
+
+// share makes the cursor latch the table by itself. Called with the table latched.
+func (ic *indexCursor) share() {
+	ic.cur.share()
+	ic.latch = ic.st.latch
+}
+
+func (ic *indexCursor) primaryKey() []byte {
+	return ic.cur.cur.key[ic.prefixLen:]
+}
+
+func (ic *indexCursor) Next() bool {
+	for ic.cur.Next() {
+		row, err := ic.getByKey(ic.primaryKey())
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			ic.err = err
+			return false
+		}
+		ic.row = row
+		return true
+	}
+	return false
+}
+
+func (ic *indexCursor) getByKey(prKey []byte) ([]interface{}, error) {
+	if ic.latch != nil {
+		ic.latch.RLock()
+		defer ic.latch.RUnlock()
+	}
+	return ic.st.getByKey(prKey)
+}
+
+func (ic *indexCursor) Values() []interface{} {
+	return ic.row
+}
+
+func (ic *indexCursor) Err() error {
+	if ic.err != nil {
+		return ic.err
+	}
+	return ic.cur.Err()
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("invalid primary key value")
+
+// Comparator orders two encoded keys.
+// It returns a negative value if a < b, zero if a == b and a positive value if a > b.
+type Comparator func(a, b []byte) int
+
+// NewKeyComparator returns a Comparator for keys made of cols.
+// Each column is decoded and compared by its type, earlier columns take precedence.
+func NewKeyComparator(cols []Column) Comparator {
+	return func(a, b []byte) int {
+		var curA, curB uint32
+		for _, col := range cols {
+			sizeA, sizeB := valueSize(col, a[curA:]), valueSize(col, b[curB:])
+			x := decodeValue(col, a[curA:curA+sizeA])
+			y := decodeValue(col, b[curB:curB+sizeB])
+			if res := compareValue(col.ty, x, y); res != 0 {
+				return res
+			}
+			curA += sizeA
+			curB += sizeB
+		}
+		return 0
+	}
+}
+
+func compareValue(ty Type, x, y interface{}) int {
+	switch ty.id {
+	case integerId:
+		a, b := x.(int32), y.(int32)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case bigintId:
+		return compareOrdered(x.(int64), y.(int64))
+	case booleanId:
+		a, b := x.(bool), y.(bool)
+		if a == b {
+			return 0
+		} else if b {
+			return -1
+		}
+		return 1
+	case doubleId:
+		a, b := x.(float64), y.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case timestampId:
+		// タイムゾーンに関係なく時刻の前後で比較する
+		a, b := x.(time.Time), y.(time.Time)
+		if a.Before(b) {
+			return -1
+		} else if a.After(b) {
+			return 1
+		}
+		return 0
+	case decimalId:
+		return compareOrdered(x.(Decimal).Unscaled, y.(Decimal).Unscaled)
+	case charId, varcharId, textId:
+		return strings.Compare(x.(string), y.(string))
+	case blobId:
+		return bytes.Compare(x.([]byte), y.([]byte))
+	}
+	panic(errors.New("not implemented"))
+}
+
+func compareOrdered(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// encodeKey builds the key from the values of key columns.
+func encodeKey(cols []Column, vals []interface{}) (key []byte, err error) {
+	if len(vals) != len(cols) {
+		return nil, ErrInvalidKey
+	}
+	for i, col := range cols {
+		if col.ty.isLarge() {
+			return nil, ErrInvalidKey
+		}
+		buf, err := encodeValue(col, vals[i])
+		if err != nil {
+			return nil, err
+		}
+		key = append(key, buf...)
+	}
+	return key, nil
+}
+
+func decodeKey(cols []Column, key []byte) []interface{} {
+	var cur uint32
+	vals := make([]interface{}, len(cols))
+	for i, col := range cols {
+		size := valueSize(col, key[cur:])
+		vals[i] = decodeValue(col, key[cur:cur+size])
+		cur += size
+	}
+	return vals
+}
+
+func keyString(cols []Column, key []byte) string {
+	vals := decodeKey(cols, key)
+	if len(vals) == 1 {
+		return fmt.Sprint(vals[0])
+	}
+	return fmt.Sprint(vals)
+}
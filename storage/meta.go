@@ -1,43 +1,175 @@
 package storage
 
 import (
+	"errors"
+
 	"github.com/tychyDB/util"
 )
 
+var ErrMetaFull = errors.New("no space left in table meta page")
+
 type MetaPage struct {
 	metaBlk BlockId
 	rootBlk BlockId
 	cols    []Column
+	keys    []uint32   // 主キーを構成するカラムのindex
+	history [][]Column // 過去のバージョンのカラム。現在のバージョンはbaseVersion+len(history)
+	// history[0]のバージョン。どのレコードからも使われなくなった古いバージョンは捨てる
+	baseVersion uint32
+	nextColId   uint32
+	used        bool // 現在のバージョンで書かれたレコードがあるか
+	indexes     []indexMeta
+	// ページを分割するまでに使う割合(%)。0なら100%
+	fillPercent uint32
+}
+
+// indexMeta describes a secondary index.
+// カラムはリネームや削除でindexが変わるのでidで持つ
+type indexMeta struct {
+	colIds  []uint32
+	unique  bool
+	rootBlk BlockId
 }
 
-func newMetaPageFromBytes(bytes []byte) MetaPage {
+// readMeta reads the meta page at metaBlk, returning ErrCorruptPage if the checksum doesn't match.
+func readMeta(fm *FileMgr, metaBlk BlockId) (MetaPage, error) {
+	_, bytes, err := fm.Read(metaBlk)
+	if err != nil {
+		return MetaPage{}, err
+	}
+	if err := checkPage(bytes); err != nil {
+		return MetaPage{}, err
+	}
+	return newMetaPageFromBytes(metaBlk, bytes), nil
+}
+
+func newMetaPageFromBytes(metaBlk BlockId, bytes []byte) MetaPage {
 	pg := &MetaPage{}
 	iter := util.NewIterStruct(0, bytes)
 	rootBlockId := iter.NextUInt32()
-	UniqueBlockId = iter.NextUInt32()
-	pg.metaBlk = NewBlockId(0, StorageFile)
+	pg.metaBlk = metaBlk
 	pg.rootBlk = NewBlockId(rootBlockId, StorageFile)
 
+	pg.cols = nextColumns(iter)
+	lenKeys := iter.NextUInt32()
+	for i := 0; i < int(lenKeys); i++ {
+		pg.keys = append(pg.keys, iter.NextUInt32())
+	}
+	pg.fillPercent = iter.NextUInt32()
+	pg.nextColId = iter.NextUInt32()
+	pg.used = iter.NextUInt32() != 0
+	lenHistory := iter.NextUInt32()
+	for i := 0; i < int(lenHistory); i++ {
+		pg.history = append(pg.history, nextColumns(iter))
+	}
+	lenIndexes := iter.NextUInt32()
+	for i := 0; i < int(lenIndexes); i++ {
+		im := indexMeta{}
+		im.rootBlk = NewBlockId(iter.NextUInt32(), StorageFile)
+		im.unique = iter.NextUInt32() != 0
+		lenIds := iter.NextUInt32()
+		for j := 0; j < int(lenIds); j++ {
+			im.colIds = append(im.colIds, iter.NextUInt32())
+		}
+		pg.indexes = append(pg.indexes, im)
+	}
+	pg.baseVersion = iter.NextUInt32()
+	return *pg
+}
+
+func nextColumns(iter *util.IterStruct) []Column {
+	var cols []Column
 	lenCols := iter.NextUInt32()
 	for i := 0; i < int(lenCols); i++ {
 		dataLen := iter.NextUInt32()
-		c := newColumnfromBytes(iter.NextBytes(dataLen))
-		pg.cols = append(pg.cols, c)
+		cols = append(cols, newColumnfromBytes(iter.NextBytes(dataLen)))
 	}
-	return *pg
+	return cols
 }
 
-func (pg *MetaPage) toBytes() []byte {
-	gen := util.NewGenStruct(0, PageSize)
-	gen.PutUInt32(pg.rootBlk.BlockNum)
-	gen.PutUInt32(UniqueBlockId)
-	gen.PutUInt32(uint32(len(pg.cols)))
-
-	for _, col := range pg.cols {
+func putColumns(gen *util.GenStruct, cols []Column) {
+	gen.PutUInt32(uint32(len(cols)))
+	for _, col := range cols {
 		buf := col.toBytes()
 		bufLen := uint32(len(buf))
 		gen.PutUInt32(bufLen)
 		gen.PutBytes(bufLen, buf)
 	}
-	return gen.DumpBytes()
+}
+
+func (pg *MetaPage) version() uint32 {
+	return pg.baseVersion + uint32(len(pg.history))
+}
+
+// columnsOf returns the columns of the records written in version.
+func (pg *MetaPage) columnsOf(version uint32) []Column {
+	if version == pg.version() {
+		return pg.cols
+	}
+	return pg.history[version-pg.baseVersion]
+}
+
+func columnsSize(cols []Column) uint32 {
+	size := uint32(IntSize)
+	for _, col := range cols {
+		size += IntSize + uint32(len(col.toBytes()))
+	}
+	return size
+}
+
+// size returns the number of bytes written by toBytes.
+func (pg *MetaPage) size() uint32 {
+	size := IntSize + columnsSize(pg.cols)
+	size += IntSize * (1 + uint32(len(pg.keys)))
+	size += 3 * IntSize
+	size += IntSize
+	for _, cols := range pg.history {
+		size += columnsSize(cols)
+	}
+	size += IntSize
+	for _, im := range pg.indexes {
+		size += IntSize * (3 + uint32(len(im.colIds)))
+	}
+	return size + IntSize + trailerSize
+}
+
+// toBytes serializes the meta page into a page of pageSize bytes.
+// It returns ErrMetaFull if the meta page doesn't fit in a page.
+func (pg *MetaPage) toBytes(pageSize uint32) ([]byte, error) {
+	if pg.size() > pageSize {
+		return nil, ErrMetaFull
+	}
+	gen := util.NewGenStruct(0, pageSize)
+	gen.PutUInt32(pg.rootBlk.BlockNum)
+	putColumns(gen, pg.cols)
+	gen.PutUInt32(uint32(len(pg.keys)))
+	for _, k := range pg.keys {
+		gen.PutUInt32(k)
+	}
+	gen.PutUInt32(pg.fillPercent)
+	gen.PutUInt32(pg.nextColId)
+	if pg.used {
+		gen.PutUInt32(1)
+	} else {
+		gen.PutUInt32(0)
+	}
+	gen.PutUInt32(uint32(len(pg.history)))
+	for _, cols := range pg.history {
+		putColumns(gen, cols)
+	}
+	gen.PutUInt32(uint32(len(pg.indexes)))
+	for _, im := range pg.indexes {
+		gen.PutUInt32(im.rootBlk.BlockNum)
+		if im.unique {
+			gen.PutUInt32(1)
+		} else {
+			gen.PutUInt32(0)
+		}
+		gen.PutUInt32(uint32(len(im.colIds)))
+		for _, id := range im.colIds {
+			gen.PutUInt32(id)
+		}
+	}
+	gen.PutUInt32(pg.baseVersion)
+	return sealPage(gen.DumpBytes()), nil
 }
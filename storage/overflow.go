@@ -0,0 +1,77 @@
+package storage
+
+import "github.com/tychyDB/util"
+
+// オーバーフローページは {次のブロック番号, このページのデータ長, データ} の形でチェーンになっている
+// 末尾にはチェックサムを置く
+const overflowHeaderSize = 2 * IntSize
+
+// writeOverflow writes data to a new chain of overflow pages and returns its blocks from the head.
+// On error the blocks allocated so far are returned so that the caller can free them.
+func writeOverflow(alloc *blockAllocator, data []byte) ([]BlockId, error) {
+	pageSize := alloc.fm.PageSize()
+	overflowCapacity := int(pageSize - overflowHeaderSize - trailerSize)
+	n := (len(data) + overflowCapacity - 1) / overflowCapacity
+	blks := make([]BlockId, 0, n)
+	for i := 0; i < n; i++ {
+		blk, err := alloc.allocate()
+		if err != nil {
+			return blks, err
+		}
+		blks = append(blks, blk)
+	}
+	for i, blk := range blks {
+		next := uint32(NullBlockNum)
+		if i+1 < n {
+			next = blks[i+1].BlockNum
+		}
+		chunk := data[i*overflowCapacity:]
+		if len(chunk) > overflowCapacity {
+			chunk = chunk[:overflowCapacity]
+		}
+		gen := util.NewGenStruct(0, pageSize)
+		gen.PutUInt32(next)
+		gen.PutUInt32(uint32(len(chunk)))
+		gen.PutBytes(uint32(len(chunk)), chunk)
+		if err := alloc.fm.Write(blk, sealPage(gen.DumpBytes())); err != nil {
+			return blks, err
+		}
+	}
+	return blks, nil
+}
+
+// readOverflow reads size bytes from the chain of overflow pages starting at blkNum.
+func readOverflow(fm *FileMgr, blkNum uint32, size uint32) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for uint32(len(data)) < size && blkNum != NullBlockNum {
+		_, bytes, err := fm.Read(NewBlockId(blkNum, StorageFile))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPage(bytes); err != nil {
+			return nil, err
+		}
+		iter := util.NewIterStruct(0, bytes)
+		blkNum = iter.NextUInt32()
+		data = append(data, iter.NextBytes(iter.NextUInt32())...)
+	}
+	return data, nil
+}
+
+// overflowBlocks returns the blocks of the chain of overflow pages starting at blkNum.
+func overflowBlocks(fm *FileMgr, blkNum uint32) ([]BlockId, error) {
+	var blks []BlockId
+	for blkNum != NullBlockNum {
+		blk := NewBlockId(blkNum, StorageFile)
+		blks = append(blks, blk)
+		_, bytes, err := fm.Read(blk)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPage(bytes); err != nil {
+			return nil, err
+		}
+		blkNum = util.NewIterStruct(0, bytes).NextUInt32()
+	}
+	return blks, nil
+}
@@ -4,40 +4,98 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"math"
 
 	"github.com/tychyDB/util"
 )
 
+// PageSize is the default size of a page. The size of each storage file is chosen by Options when it is created.
 const PageSize = 4096
-const PageHeaderSize = 17
-const MaxDegree = 3
+const PageHeaderSize = 37
 const IntSize = 4
 
+// セルごとにスロット配列とポインタ配列の要素を1つずつ使う
+const slotOverhead = 2 * IntSize
+
+// 1ページに1セルは必ず入り、内部ノードには分割できるだけのキーが入るように上限を設ける
+func maxCellSize(pageSize uint32) uint32 {
+	return pageSize - PageHeaderSize - slotOverhead
+}
+
+func maxKeySize(pageSize uint32) uint32 {
+	return (pageSize-PageHeaderSize)/4 - 2*IntSize - slotOverhead
+}
+
+var (
+	ErrRecordTooLarge = errors.New("record too large to fit in a page")
+	ErrKeyTooLarge    = errors.New("key too large")
+	ErrCorruptPage    = errors.New("page checksum mismatch")
+)
+
+// NullBlockNum means that there is no sibling page
+const NullBlockNum = math.MaxUint32
+
+// A page is laid out as
+// | header | slot array | ptr array | free space | cells |
+// The slot array holds the offset of each cell, 0 for a tombstoned slot.
+// The ptr array holds slot numbers in key order. Cells grow from the end of the page toward freeOffset.
 type PageHeader struct {
 	isLeaf       bool
 	numOfPtr     uint32
-	rightmostPtr uint32
+	rightmostPtr uint32 // NonLeafPageのrightmostのセルのスロット番号
 	pageLSN      uint32
 	recLSN       uint32
+	prevPtr      uint32 // リーフページのみ有効
+	nextPtr      uint32 // リーフページのみ有効
+	numOfSlot    uint32
+	freeOffset   uint32 // セル領域の先頭
+	checksum     uint32 // ページ全体のCRC32。計算するときはこのフィールドを0とみなす
 }
 
-func (header PageHeader) toBytes() []byte {
-	gen := util.NewGenStruct(0, PageHeaderSize)
-	gen.PutBool(header.isLeaf)
-	gen.PutUInt32(header.numOfPtr)
-	gen.PutUInt32(header.rightmostPtr) // dummy value is okay
-	gen.PutUInt32(header.pageLSN)
-	gen.PutUInt32(header.recLSN)
-	return gen.DumpBytes()
+// checksumOffset is the position of PageHeader.checksum in a page
+const checksumOffset = PageHeaderSize - IntSize
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// pageChecksum returns the checksum of the serialized page bytes.
+func pageChecksum(bytes []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, bytes[:checksumOffset])
+	crc = crc32.Update(crc, castagnoli, make([]byte, IntSize))
+	return crc32.Update(crc, castagnoli, bytes[PageHeaderSize:])
 }
 
-func (header PageHeader) toBytesNonLeaf(rightmostPtrValue uint32) []byte {
+// 木以外のページ(カタログ、メタ、空き、オーバーフロー)は末尾にページのCRC32を置く
+const trailerSize = IntSize
+
+// sealPage writes the checksum of buf into its last bytes and returns buf.
+func sealPage(buf []byte) []byte {
+	end := len(buf) - trailerSize
+	binary.BigEndian.PutUint32(buf[end:], crc32.Checksum(buf[:end], castagnoli))
+	return buf
+}
+
+// checkPage returns ErrCorruptPage if the checksum written by sealPage doesn't match buf.
+func checkPage(buf []byte) error {
+	end := len(buf) - trailerSize
+	if end < 0 || binary.BigEndian.Uint32(buf[end:]) != crc32.Checksum(buf[:end], castagnoli) {
+		return ErrCorruptPage
+	}
+	return nil
+}
+
+func (header PageHeader) toBytes() []byte {
 	gen := util.NewGenStruct(0, PageHeaderSize)
 	gen.PutBool(header.isLeaf)
 	gen.PutUInt32(header.numOfPtr)
-	gen.PutUInt32(rightmostPtrValue)
+	gen.PutUInt32(header.rightmostPtr) // dummy value is okay
 	gen.PutUInt32(header.pageLSN)
 	gen.PutUInt32(header.recLSN)
+	gen.PutUInt32(header.prevPtr)
+	gen.PutUInt32(header.nextPtr)
+	gen.PutUInt32(header.numOfSlot)
+	gen.PutUInt32(header.freeOffset)
+	gen.PutUInt32(header.checksum)
 	return gen.DumpBytes()
 }
 
@@ -46,68 +104,180 @@ func newPageHeaderFromBytes(bytes []byte) PageHeader {
 		panic(errors.New("bytes length must be PageHeaderSize"))
 	}
 	iter := util.NewIterStruct(0, bytes)
-	isLeaf := iter.NextBool()
-	numOfPtr := iter.NextUInt32()
-	rightmostPtr := iter.NextUInt32() // ここで読んだときにはまだディスク上の4096byteのどこからcellが始まるかを示している
-	pageLSN := iter.NextUInt32()
-	recLSN := iter.NextUInt32()
-	return PageHeader{isLeaf: isLeaf, numOfPtr: numOfPtr, rightmostPtr: rightmostPtr, pageLSN: pageLSN, recLSN: recLSN}
+	header := PageHeader{}
+	header.isLeaf = iter.NextBool()
+	header.numOfPtr = iter.NextUInt32()
+	header.rightmostPtr = iter.NextUInt32()
+	header.pageLSN = iter.NextUInt32()
+	header.recLSN = iter.NextUInt32()
+	header.prevPtr = iter.NextUInt32()
+	header.nextPtr = iter.NextUInt32()
+	header.numOfSlot = iter.NextUInt32()
+	header.freeOffset = iter.NextUInt32()
+	header.checksum = iter.NextUInt32()
+	return header
 }
 
 type Page struct {
-	header PageHeader
-	ptrs   []uint32 // cellsのindexを保持する
-	cells  []Cell   // [0]が最初に挿入されたセル
+	header  PageHeader
+	ptrs    []uint32 // cellsのindexをキーの順に保持する
+	cells   []Cell   // スロット。削除されたセルはnilで、次の挿入で再利用される
+	offsets []uint32 // 各セルのページ内の位置。0はまだ配置されていないことを示す
+	size    uint32
+	blk     BlockId // バッファプールに載せる時に設定される
+	dirty   bool    // ディスクから読んだ後に変更されたか。追い出す時に書き戻すかを決める
 }
 
-func newPage(isLeaf bool) *Page {
+func newPage(isLeaf bool, size uint32) *Page {
 	pg := &Page{}
-	pg.header = PageHeader{isLeaf: isLeaf, numOfPtr: 0}
+	pg.size = size
+	pg.header = PageHeader{isLeaf: isLeaf, numOfPtr: 0, prevPtr: NullBlockNum, nextPtr: NullBlockNum, freeOffset: size}
 	pg.ptrs = make([]uint32, 0)
 	pg.cells = make([]Cell, 0)
+	pg.offsets = make([]uint32, 0)
+	pg.dirty = true
 	return pg
 }
 
-func newPageFromBytes(bytes []byte) *Page {
-	if len(bytes) != PageSize {
-		panic(errors.New("bytes length must be PageSize"))
+// newPageFromBytes returns ErrCorruptPage if the checksum doesn't match,
+// which happens when the page was partially written or damaged on disk.
+func newPageFromBytes(bytes []byte) (*Page, error) {
+	if len(bytes) < PageHeaderSize {
+		return nil, ErrCorruptPage
 	}
 	pg := &Page{}
+	pg.size = uint32(len(bytes))
 	pg.header = newPageHeaderFromBytes(bytes[:PageHeaderSize])
+	if pg.header.checksum != pageChecksum(bytes) {
+		return nil, ErrCorruptPage
+	}
 
-	if pg.header.isLeaf {
-		pg.ptrs = make([]uint32, pg.header.numOfPtr)
-		for i := 0; i < int(pg.header.numOfPtr); i++ {
-			value := binary.BigEndian.Uint32(bytes[PageHeaderSize+i*IntSize : PageHeaderSize+(i+1)*IntSize])
-			cell := KeyValueCell{}.fromBytes(bytes[value:])
-			pg.ptrs[i] = uint32(i)
-			pg.cells = append(pg.cells, cell)
+	cur := uint32(PageHeaderSize)
+	pg.cells = make([]Cell, pg.header.numOfSlot)
+	pg.offsets = make([]uint32, pg.header.numOfSlot)
+	for i := range pg.cells {
+		offset := binary.BigEndian.Uint32(bytes[cur : cur+IntSize])
+		cur += IntSize
+		if offset == 0 {
+			continue
 		}
+		if pg.header.isLeaf {
+			pg.cells[i] = KeyValueCell{}.fromBytes(bytes[offset:])
+		} else {
+			pg.cells[i] = KeyCell{}.fromBytes(bytes[offset:])
+		}
+		pg.offsets[i] = offset
+	}
+	pg.ptrs = make([]uint32, pg.numOfPtrs())
+	for i := range pg.ptrs {
+		pg.ptrs[i] = binary.BigEndian.Uint32(bytes[cur : cur+IntSize])
+		cur += IntSize
+	}
+	return pg, nil
+}
 
-	} else {
-		pg.ptrs = make([]uint32, pg.header.numOfPtr-1)
-		for i := 0; i < int(pg.header.numOfPtr-1); i++ {
-			value := binary.BigEndian.Uint32(bytes[PageHeaderSize+i*IntSize : PageHeaderSize+(i+1)*IntSize])
-			cell := KeyCell{}.fromBytes(bytes[value:])
-			pg.ptrs[i] = uint32(i)
-			pg.cells = append(pg.cells, cell)
+// numOfPtrs returns the length of the ptr array.
+// NonLeafPageのrightmostのセルはポインタ配列に入らない
+func (pg *Page) numOfPtrs() uint32 {
+	if !pg.header.isLeaf && pg.header.numOfPtr > 0 {
+		return pg.header.numOfPtr - 1
+	}
+	return pg.header.numOfPtr
+}
+
+// freeSpace returns the bytes between the end of the ptr array and the cells.
+func (pg *Page) freeSpace() uint32 {
+	arraysEnd := PageHeaderSize + IntSize*uint32(len(pg.cells)+len(pg.ptrs))
+	if pg.header.freeOffset < arraysEnd {
+		return 0
+	}
+	return pg.header.freeOffset - arraysEnd
+}
+
+// newSlot stores cell in a tombstoned slot, or in a new slot if there is none.
+// The cell is not placed yet, call place after the slot is added to ptrs.
+func (pg *Page) newSlot(cell Cell) uint32 {
+	pg.dirty = true
+	for i, c := range pg.cells {
+		if c == nil {
+			pg.cells[i] = cell
+			return uint32(i)
 		}
-		rightmostCell := KeyCell{}.fromBytes(bytes[pg.header.rightmostPtr:])
-		pg.cells = append(pg.cells, rightmostCell)
-		pg.header.rightmostPtr = pg.header.numOfPtr - 1
 	}
-	return pg
+	pg.cells = append(pg.cells, cell)
+	pg.offsets = append(pg.offsets, 0)
+	pg.header.numOfSlot++
+	return uint32(len(pg.cells) - 1)
 }
 
-func (pg *Page) locateLocally(key int32) uint32 {
-	for i, ptr := range pg.ptrs {
-		var compared int32
-		if pg.header.isLeaf {
-			compared = pg.cells[ptr].(KeyValueCell).key
-		} else {
-			compared = pg.cells[ptr].(KeyCell).key
+// place allocates the bytes of the cell in slot from the free space.
+// 連続した空きが足りなければページを詰め直す。それでも溢れる場合は分割されるまで配置しない
+func (pg *Page) place(slot uint32) {
+	size := pg.cells[slot].getSize()
+	if pg.freeSpace() >= size {
+		pg.header.freeOffset -= size
+		pg.offsets[slot] = pg.header.freeOffset
+		return
+	}
+	pg.offsets[slot] = 0
+	if pg.usedBytes() <= pg.size {
+		pg.compact()
+	}
+}
+
+// free tombstones slot. The bytes of the cell are reclaimed by compact,
+// unless the cell is at the head of the cell area.
+func (pg *Page) free(slot uint32) {
+	pg.dirty = true
+	if pg.offsets[slot] != 0 && pg.offsets[slot] == pg.header.freeOffset {
+		pg.header.freeOffset += pg.cells[slot].getSize()
+	}
+	pg.cells[slot] = nil
+	pg.offsets[slot] = 0
+	// 末尾のスロットはスロット配列ごと縮める
+	n := len(pg.cells)
+	for n > 0 && pg.cells[n-1] == nil {
+		n--
+	}
+	pg.cells = pg.cells[:n]
+	pg.offsets = pg.offsets[:n]
+	pg.header.numOfSlot = uint32(n)
+}
+
+// replaceCell overwrites the cell in slot.
+// 元のセル以下の大きさなら同じ位置に書き込む
+func (pg *Page) replaceCell(slot uint32, cell Cell) {
+	pg.dirty = true
+	old := pg.cells[slot]
+	pg.cells[slot] = cell
+	if pg.offsets[slot] != 0 && cell.getSize() <= old.getSize() {
+		return
+	}
+	if pg.offsets[slot] == pg.header.freeOffset && pg.offsets[slot] != 0 {
+		pg.header.freeOffset += old.getSize()
+	}
+	pg.place(slot)
+}
+
+// compact drops tombstoned slots and packs the live cells at the end of the page,
+// so that all the free space of the page becomes contiguous.
+func (pg *Page) compact() {
+	pg.setEntries(pg.entries())
+}
+
+// placed reports whether every live cell has its bytes in the page.
+func (pg *Page) placed() bool {
+	for i, cell := range pg.cells {
+		if cell != nil && pg.offsets[i] == 0 {
+			return false
 		}
-		if key < compared {
+	}
+	return true
+}
+
+func (pg *Page) locateLocally(cmp Comparator, key []byte) uint32 {
+	for i, ptr := range pg.ptrs {
+		if cmp(key, pg.cells[ptr].getKey()) < 0 {
 			return uint32(i)
 		}
 	}
@@ -121,26 +291,160 @@ func insertInt(index int, item uint32, arr []uint32) []uint32 {
 	return arr
 }
 
-// NonLeafPageではrightmost ptrが有効になるため分割条件が異なる
-func (pg *Page) needSplit() bool {
-	if pg.header.isLeaf {
-		return pg.header.numOfPtr >= MaxDegree
-	} else {
-		return pg.header.numOfPtr > MaxDegree
+// usedBytes returns the size of a compacted page holding entries.
+// NonLeafPageのrightmostのセルはポインタ配列に入らない
+func usedBytes(isLeaf bool, entries []Cell) uint32 {
+	size := uint32(PageHeaderSize)
+	for _, cell := range entries {
+		size += slotOverhead + cell.getSize()
+	}
+	if !isLeaf && len(entries) > 0 {
+		size -= IntSize
 	}
+	return size
 }
 
-func (pg *Page) addRecordRec(ptb *PageTable, rec Record) (splitted bool, splitKey int32, leftPageIndex uint32) {
-	key := rec.getKey()
-	insert_idx := pg.locateLocally(key)
+func (pg *Page) usedBytes() uint32 {
+	return usedBytes(pg.header.isLeaf, pg.entries())
+}
+
+// minEntries is the least number of entries a page keeps after a split or redistribution
+func minEntries(isLeaf bool, n int) int {
+	if !isLeaf && n >= 4 {
+		return 2
+	}
+	return 1
+}
+
+func (pg *Page) needSplit(limit uint32) bool {
+	if pg.header.isLeaf && pg.header.numOfPtr < 2 || !pg.header.isLeaf && pg.header.numOfPtr < 3 {
+		return false
+	}
+	return pg.usedBytes() > limit || pg.usedBytes() > pg.size
+}
+
+// 使用量が上限の1/4を下回ったら兄弟ページと併合または再分配する
+func (pg *Page) underflow(limit uint32) bool {
+	if !pg.header.isLeaf && pg.header.numOfPtr < 2 || pg.header.numOfPtr == 0 {
+		return true
+	}
+	return pg.usedBytes() < limit/4
+}
+
+// splitPoint returns the number of entries to put on the left page
+// so that the bytes of both pages are as equal as possible.
+func splitPoint(isLeaf bool, entries []Cell) int {
+	n := len(entries)
+	m := minEntries(isLeaf, n)
+	total := usedBytes(isLeaf, entries)
+	best, bestDiff := m, int64(-1)
+	for i := m; i <= n-m; i++ {
+		left := int64(usedBytes(isLeaf, entries[:i]))
+		diff := left - (int64(total) - left)
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff == -1 || diff < bestDiff {
+			best, bestDiff = i, diff
+		}
+	}
+	return best
+}
+
+// childIndex returns the index of the child that may contain key.
+// The rightmost child is numOfPtr-1.
+func (pg *Page) childIndex(cmp Comparator, key []byte) uint32 {
+	idx := pg.locateLocally(cmp, key)
+	if idx >= pg.header.numOfPtr {
+		idx = pg.header.numOfPtr - 1
+	}
+	return idx
+}
+
+func (pg *Page) childAt(idx uint32) uint32 {
+	if idx == pg.header.numOfPtr-1 {
+		return pg.cells[pg.header.rightmostPtr].(KeyCell).pageIndex
+	}
+	return pg.cells[pg.ptrs[idx]].(KeyCell).pageIndex
+}
+
+// entries returns the cells in key order.
+// For a non-leaf page the rightmost cell comes last.
+func (pg *Page) entries() []Cell {
+	res := make([]Cell, 0, pg.header.numOfPtr)
+	for _, ptr := range pg.ptrs {
+		res = append(res, pg.cells[ptr])
+	}
+	if !pg.header.isLeaf && pg.header.numOfPtr > 0 {
+		res = append(res, pg.cells[pg.header.rightmostPtr])
+	}
+	return res
+}
+
+// setEntries replaces the content of the page with cells given in key order.
+// セルは隙間なく末尾から配置される
+func (pg *Page) setEntries(cells []Cell) {
+	pg.dirty = true
+	n := uint32(len(cells))
+	pg.cells = make([]Cell, n)
+	copy(pg.cells, cells)
+	pg.header.numOfSlot = n
+	pg.header.numOfPtr = n
+	if !pg.header.isLeaf && n > 0 {
+		pg.header.rightmostPtr = n - 1
+	}
+	pg.ptrs = make([]uint32, pg.numOfPtrs())
+	for i := range pg.ptrs {
+		pg.ptrs[i] = uint32(i)
+	}
+	pg.offsets = make([]uint32, n)
+	pg.header.freeOffset = pg.size
+	if usedBytes(pg.header.isLeaf, cells) > pg.size {
+		// 分割されるまで配置しない
+		return
+	}
+	for i, cell := range cells {
+		pg.header.freeOffset -= cell.getSize()
+		pg.offsets[i] = pg.header.freeOffset
+	}
+}
+
+func (pg *Page) findKey(cmp Comparator, key []byte) int {
+	for i, ptr := range pg.ptrs {
+		if cmp(pg.cells[ptr].getKey(), key) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// addRecordRec inserts cell into the subtree whose root is pg.
+// If the key already exists, the record is replaced when replace is true,
+// otherwise ErrDuplicateKey is returned and the tree is left unchanged.
+// pg is latched exclusively and its latch is in bt.held. The left page of a split is returned unlatched.
+func (pg *Page) addRecordRec(bt *btree, cell KeyValueCell, replace bool) (splitted bool, splitKey []byte, leftPageIndex uint32, err error) {
+	ptb, cmp := bt.ptb, bt.cmp
+	insert_idx := pg.locateLocally(cmp, cell.key)
 	if pg.header.isLeaf {
-		if len(pg.ptrs) == 0 {
-			pg.ptrs = append(pg.ptrs, 0)
-		} else {
-			pg.ptrs = insertInt(int(insert_idx), uint32(len(pg.cells)), pg.ptrs)
+		// 同じキーを持つセルは挿入位置の直前にある
+		found := false
+		if insert_idx > 0 {
+			prevIdx := pg.ptrs[insert_idx-1]
+			if cmp(pg.cells[prevIdx].getKey(), cell.key) == 0 {
+				if !replace {
+					return false, nil, 0, ErrDuplicateKey
+				}
+				// 置き換えでセルが大きくなることがあるので分割の判定は行う
+				pg.replaceCell(prevIdx, cell)
+				found = true
+			}
+		}
+		if !found {
+			slot := pg.newSlot(cell)
+			pg.ptrs = insertInt(int(insert_idx), slot, pg.ptrs)
+			pg.header.numOfPtr++
+			pg.place(slot)
 		}
-		pg.cells = append(pg.cells, KeyValueCell{key: key, rec: rec})
-		pg.header.numOfPtr++
 	} else {
 		var pageIndex uint32
 		if insert_idx == pg.header.numOfPtr {
@@ -151,74 +455,217 @@ func (pg *Page) addRecordRec(ptb *PageTable, rec Record) (splitted bool, splitKe
 		}
 		blk := NewBlockId(pageIndex, StorageFile)
 
-		splitted, splitKey, leftPageIndex := ptb.pin(blk).addRecordRec(ptb, rec)
-		if splitted {
-			if insert_idx == pg.header.numOfPtr {
-				// locatelocallyがrightmost ptrを返す時には
-				// len(pg.ptr)はpg.header.numOfptr-1になっていることに合わせる
-				insert_idx--
-			}
-			pg.ptrs = insertInt(int(insert_idx), uint32(len(pg.cells)), pg.ptrs)
-			pg.cells = append(pg.cells, KeyCell{key: splitKey, pageIndex: leftPageIndex})
-			pg.header.numOfPtr++
-			ptb.unpin(NewBlockId(leftPageIndex, StorageFile))
+		// ラッチカップリング: 子が分割されないと分かれば祖先のラッチを外す
+		child, err := ptb.latch(blk, latchExclusive)
+		if err != nil {
+			return false, nil, 0, err
+		}
+		if bt.safe(child, cell) {
+			bt.releaseHeld()
 		}
-		ptb.unpin(blk)
+		bt.held = append(bt.held, blk)
+		splitted, splitKey, leftPageIndex, err := child.addRecordRec(bt, cell, replace)
+		if err != nil || !splitted {
+			// 子が分割されていなければpgは変わらない。pgのラッチはもう外れていることがある
+			return false, nil, 0, err
+		}
+		if insert_idx == pg.header.numOfPtr {
+			// locatelocallyがrightmost ptrを返す時には
+			// len(pg.ptr)はpg.header.numOfptr-1になっていることに合わせる
+			insert_idx--
+		}
+		slot := pg.newSlot(KeyCell{key: splitKey, pageIndex: leftPageIndex})
+		pg.ptrs = insertInt(int(insert_idx), slot, pg.ptrs)
+		pg.header.numOfPtr++
+		pg.place(slot)
 	}
 
-	if pg.needSplit() {
+	if pg.needSplit(bt.limit) {
 		splitted = true
-		splitIndex := pg.header.numOfPtr / 2
+		splitIndex := uint32(splitPoint(pg.header.isLeaf, pg.entries()))
 		if pg.header.isLeaf {
 			splitKey = pg.cells[pg.ptrs[splitIndex]].getKey()
 		} else {
 			splitKey = pg.cells[pg.ptrs[splitIndex-1]].getKey()
 		}
-		leftPage := newPage(pg.header.isLeaf)
-		blk := newUniqueBlockId(StorageFile)
-		ptb.set(blk, leftPage)
-		ptb.pin(blk)
+		leftPage := newPage(pg.header.isLeaf, pg.size)
+		blk, err := bt.alloc.allocate()
+		if err != nil {
+			return false, nil, 0, err
+		}
+		if err := ptb.set(blk, leftPage); err != nil {
+			return false, nil, 0, err
+		}
 		leftPageIndex = blk.BlockNum
-		leftPage.ptrs = make([]uint32, splitIndex)
-		leftPage.cells = make([]Cell, splitIndex)
+		// NonLeafPageでは最後のセルが左ページのrightmost ptrになる
+		leftCells := make([]Cell, splitIndex)
 		for i := 0; i < int(splitIndex); i++ {
-			leftPage.ptrs[i] = uint32(i)
-			leftPage.cells[i] = pg.cells[pg.ptrs[i]]
+			leftCells[i] = pg.cells[pg.ptrs[i]]
+		}
+		leftPage.setEntries(leftCells)
+		if pg.header.isLeaf {
+			// 左ページをpgの直前に連結する
+			leftPage.header.prevPtr = pg.header.prevPtr
+			leftPage.header.nextPtr = pg.blk.BlockNum
+			if pg.header.prevPtr != NullBlockNum {
+				// リーフのラッチは右から左の順にだけ取るのでデッドロックしない
+				prevBlk := NewBlockId(pg.header.prevPtr, StorageFile)
+				prev, err := ptb.latch(prevBlk, latchExclusive)
+				if err != nil {
+					ptb.unlatch(blk, latchExclusive)
+					return false, nil, 0, err
+				}
+				prev.header.nextPtr = leftPageIndex
+				prev.dirty = true
+				ptb.unlatch(prevBlk, latchExclusive)
+			}
+			pg.header.prevPtr = leftPageIndex
 		}
-		leftPage.header.numOfPtr = splitIndex
-		if !pg.header.isLeaf {
-			leftPage.header.rightmostPtr = splitIndex - 1
+		ptb.unlatch(blk, latchExclusive)
+		// 左ページに移したセルのスロットは空けておき、次の挿入で再利用する
+		for _, ptr := range pg.ptrs[:splitIndex] {
+			pg.free(ptr)
 		}
 		pg.ptrs = pg.ptrs[splitIndex:]
 		pg.header.numOfPtr -= splitIndex
+		if !pg.placed() {
+			pg.compact()
+		}
 	} else {
 		splitted = false
 	}
 	return
 }
 
-func (pg *Page) toBytes() []byte {
-	buf := make([]byte, PageSize)
-	cur := uint32(PageSize)
-	var ptrRawValues []uint32
-	for _, ptr := range pg.ptrs {
-		cell := pg.cells[ptr]
-		copy(buf[cur-cell.getSize():cur], cell.toBytes())
-		cur = cur - cell.getSize()
-		ptrRawValues = append(ptrRawValues, cur)
+// deleteRecordRec removes the cell having key from the subtree whose root is pg.
+// It reports whether pg has to be merged with or borrow from its sibling.
+func (pg *Page) deleteRecordRec(bt *btree, key []byte) (underflow bool, err error) {
+	ptb, cmp := bt.ptb, bt.cmp
+	if pg.header.isLeaf {
+		idx := pg.findKey(cmp, key)
+		if idx == -1 {
+			return false, ErrKeyNotFound
+		}
+		slot := pg.ptrs[idx]
+		pg.ptrs = append(pg.ptrs[:idx], pg.ptrs[idx+1:]...)
+		pg.header.numOfPtr--
+		pg.free(slot)
+		return pg.underflow(bt.limit), nil
 	}
-	for i, value := range ptrRawValues {
-		binary.BigEndian.PutUint32(buf[PageHeaderSize+i*IntSize:PageHeaderSize+(i+1)*IntSize], value)
+
+	childIdx := pg.childIndex(cmp, key)
+	childBlk := NewBlockId(pg.childAt(childIdx), StorageFile)
+	child, err := ptb.latch(childBlk, latchExclusive)
+	if err != nil {
+		return false, err
 	}
+	childUnderflow, err := child.deleteRecordRec(bt, key)
+	if err == nil && childUnderflow {
+		err = pg.rebalance(bt, childIdx, child)
+	}
+	ptb.unlatch(childBlk, latchExclusive)
+	return pg.underflow(bt.limit), err
+}
 
-	if pg.header.isLeaf {
-		copy(buf[:PageHeaderSize], pg.header.toBytes())
+// rebalance fixes the underflowed child at childIdx by merging it with its sibling,
+// or by redistributing cells between them if they don't fit in one page.
+// 分割時と同様に右側のページを残し、左側のページを親から外す
+func (pg *Page) rebalance(bt *btree, childIdx uint32, child *Page) error {
+	ptb := bt.ptb
+	if pg.header.numOfPtr < 2 {
+		// 兄弟が存在しない
+		return nil
+	}
+	var leftIdx uint32
+	var siblingBlk BlockId
+	if childIdx > 0 {
+		leftIdx = childIdx - 1
+		siblingBlk = NewBlockId(pg.childAt(leftIdx), StorageFile)
+	} else {
+		leftIdx = childIdx
+		siblingBlk = NewBlockId(pg.childAt(childIdx+1), StorageFile)
+	}
+	sibling, err := ptb.latch(siblingBlk, latchExclusive)
+	if err != nil {
+		return err
+	}
+	defer ptb.unlatch(siblingBlk, latchExclusive)
+	leftPage, rightPage := sibling, child
+	if childIdx == 0 {
+		leftPage, rightPage = child, sibling
+	}
+
+	entries := pg.entries()
+	sep := entries[leftIdx].(KeyCell)
+	leftEntries := leftPage.entries()
+	if !leftPage.header.isLeaf {
+		// 左ページのrightmostのキーは親の区切りキーと一致させる
+		last := leftEntries[len(leftEntries)-1].(KeyCell)
+		last.key = sep.key
+		leftEntries[len(leftEntries)-1] = last
+	}
+	merged := append(leftEntries, rightPage.entries()...)
+
+	if usedBytes(rightPage.header.isLeaf, merged) <= bt.limit {
+		if rightPage.header.isLeaf {
+			if leftPage.header.prevPtr != NullBlockNum {
+				prevBlk := NewBlockId(leftPage.header.prevPtr, StorageFile)
+				prev, err := ptb.latch(prevBlk, latchExclusive)
+				if err != nil {
+					return err
+				}
+				prev.header.nextPtr = rightPage.blk.BlockNum
+				prev.dirty = true
+				ptb.unlatch(prevBlk, latchExclusive)
+			}
+			rightPage.header.prevPtr = leftPage.header.prevPtr
+		}
+		rightPage.setEntries(merged)
+		leftPage.setEntries([]Cell{})
+		bt.freed = append(bt.freed, leftPage.blk)
+		entries = append(entries[:leftIdx], entries[leftIdx+1:]...)
 	} else {
-		rightmostCell := pg.cells[pg.header.rightmostPtr]
-		copy(buf[cur-rightmostCell.getSize():cur], rightmostCell.toBytes())
-		cur = cur - rightmostCell.getSize()
-		copy(buf[:PageHeaderSize], pg.header.toBytesNonLeaf(cur))
+		half := splitPoint(rightPage.header.isLeaf, merged)
+		if rightPage.header.isLeaf {
+			sep.key = merged[half].getKey()
+		} else {
+			sep.key = merged[half-1].getKey()
+		}
+		entries[leftIdx] = sep
+		// 区切りキーが長くなって親に収まらなければ、そのままにしておく
+		if usedBytes(pg.header.isLeaf, entries) > pg.size {
+			return nil
+		}
+		leftPage.setEntries(merged[:half])
+		rightPage.setEntries(merged[half:])
+	}
+	pg.setEntries(entries)
+	return nil
+}
+
+func (pg *Page) toBytes() []byte {
+	if !pg.placed() {
+		pg.compact()
+		if !pg.placed() {
+			panic(errors.New("page overflow"))
+		}
+	}
+	buf := make([]byte, pg.size)
+	copy(buf[:PageHeaderSize], pg.header.toBytes())
+	cur := uint32(PageHeaderSize)
+	for i, cell := range pg.cells {
+		binary.BigEndian.PutUint32(buf[cur:cur+IntSize], pg.offsets[i])
+		cur += IntSize
+		if cell != nil {
+			copy(buf[pg.offsets[i]:], cell.toBytes())
+		}
+	}
+	for _, ptr := range pg.ptrs {
+		binary.BigEndian.PutUint32(buf[cur:cur+IntSize], ptr)
+		cur += IntSize
 	}
+	pg.header.checksum = pageChecksum(buf)
+	binary.BigEndian.PutUint32(buf[checksumOffset:PageHeaderSize], pg.header.checksum)
 	return buf
 }
 
@@ -229,5 +676,6 @@ func (pg *Page) info() {
 	fmt.Printf("len(ptrs) %d, ptrs... %v\n", len(pg.ptrs), pg.ptrs)
 	fmt.Printf("rightmost ptr ... %d\n", pg.header.rightmostPtr)
 	fmt.Printf("len(cells) %d, cells... %v\n", len(pg.cells), pg.cells)
+	fmt.Printf("free offset ... %d, free space ... %d\n", pg.header.freeOffset, pg.freeSpace())
 	fmt.Printf("}\n")
 }
@@ -3,145 +3,380 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultWaitTimeout is how long a page waits for a frame of a full buffer pool by default
+const DefaultWaitTimeout = 5 * time.Second
+
+var ErrBufferPoolFull = errors.New("no unpinned page in buffer pool")
 
-	"github.com/tychyDB/algorithm"
+// latchMode is the mode of the latch of a frame.
+// 共有ラッチは読むだけの操作が、排他ラッチはページを書き換える操作が取る
+type latchMode int
+
+const (
+	latchShared latchMode = iota
+	latchExclusive
 )
 
 // The page table keeps track of pages
 // that are currently in memory.
 // Also maintains additional meta-data per page
+//
+// The page table is safe for concurrent use. mu guards the table and the frames,
+// and the content of each page is guarded by the latch of its frame.
+// ラッチを待つ間はmuを持たない。muを持ったままラッチを取るとデッドロックする
 type PageTable struct {
 	bm       *BufferMgr
 	numOfPin int
 	table    map[int]int
-	queue    algorithm.Queue
+	rp       replacer
+	policy   ReplacementPolicy
+	stats    BufferStats
+	cold     map[int]bool // リングに読み込まれてから、ほかの操作に使われていないページ
+	mu       sync.Mutex
+	timeout  time.Duration
+	unpinned chan struct{} // 空きを待っている間だけ作られ、unpinで閉じられる
 }
 
 func NewPageTable(bm *BufferMgr) *PageTable {
+	ptb, _ := newPageTable(bm, ClockReplacement)
+	return ptb
+}
+
+func newPageTable(bm *BufferMgr, policy ReplacementPolicy) (*PageTable, error) {
+	rp, err := newReplacer(policy, bm.size())
+	if err != nil {
+		return nil, err
+	}
 	ptb := &PageTable{}
 	ptb.bm = bm
 	ptb.numOfPin = 0
 	ptb.table = make(map[int]int)
-	ptb.queue = algorithm.NewQueue(64)
-	return ptb
+	ptb.cold = make(map[int]bool)
+	ptb.rp = rp
+	ptb.policy = policy
+	ptb.timeout = DefaultWaitTimeout
+	return ptb, nil
+}
+
+// Policy returns the replacement policy of the buffer pool.
+func (ptb *PageTable) Policy() ReplacementPolicy {
+	return ptb.policy
+}
+
+// Stats returns the counts of hits, misses and evictions of the buffer pool so far.
+func (ptb *PageTable) Stats() BufferStats {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
+	return ptb.stats
+}
+
+// blockNums returns the blocks in the buffer pool in ascending order.
+func (ptb *PageTable) blockNums() []int {
+	blkNums := make([]int, 0, len(ptb.table))
+	for blkNum := range ptb.table {
+		blkNums = append(blkNums, blkNum)
+	}
+	sort.Ints(blkNums)
+	return blkNums
+}
+
+// SetWaitTimeout sets how long reading a page waits for a page to be unpinned
+// when all the pages in the buffer pool are pinned. After that ErrBufferPoolFull is returned.
+func (ptb *PageTable) SetWaitTimeout(timeout time.Duration) {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
+	ptb.timeout = timeout
 }
 
 func (ptb *PageTable) ClearBuffer() {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
 	// for testing
-	for {
-		if ptb.queue.IsEmpty() {
-			break
-		}
-		curBlkNum := ptb.queue.Pop()
-		curBuffId := ptb.table[int(curBlkNum)]
-		delete(ptb.table, int(curBlkNum))
+	for _, curBlkNum := range ptb.blockNums() {
+		curBuffId := ptb.table[curBlkNum]
+		delete(ptb.table, curBlkNum)
+		delete(ptb.cold, curBlkNum)
+		ptb.rp.removed(curBlkNum)
 		ptb.bm.clear(curBuffId)
 	}
 	ptb.numOfPin = 0
 }
 
-func (ptb *PageTable) Flush() {
-	for {
-		if ptb.queue.IsEmpty() {
-			break
+// Flush writes all the pages back and empties the buffer pool.
+// Pages pinned by operations in progress are left in the pool and written by a later Flush.
+// If a page cannot be written, it is left in the pool and the error is returned.
+func (ptb *PageTable) Flush() error {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
+	for _, curBlkNum := range ptb.blockNums() {
+		curBuffId := ptb.table[curBlkNum]
+		if ptb.bm.isPinned(curBuffId) {
+			continue
+		}
+		if err := ptb.bm.flush(curBuffId); err != nil {
+			return err
 		}
-		curBlkNum := ptb.queue.Pop()
-		curBuffId := ptb.table[int(curBlkNum)]
-		delete(ptb.table, int(curBlkNum))
-		ptb.bm.flush(curBuffId)
+		delete(ptb.table, curBlkNum)
+		delete(ptb.cold, curBlkNum)
+		ptb.rp.removed(curBlkNum)
 	}
-	ptb.numOfPin = 0
+	return nil
 }
 
-func (ptb *PageTable) makeSpace() {
-	if len(ptb.table) > MaxBufferPoolSize {
+func (ptb *PageTable) makeSpace() error {
+	if len(ptb.table) > ptb.bm.size() {
 		panic(errors.New("unexpected"))
-	} else if len(ptb.table) < MaxBufferPoolSize {
-		return
+	} else if len(ptb.table) < ptb.bm.size() {
+		return nil
+	}
+	if err := ptb.waitAvailable(); err != nil {
+		return err
+	}
+	// 待っている間に他のページが追い出されていれば空きがある
+	if len(ptb.table) < ptb.bm.size() {
+		return nil
+	}
+	dropBlkNum, ok := ptb.rp.victim(func(blkNum int) bool {
+		return !ptb.bm.isPinned(ptb.table[blkNum])
+	})
+	if !ok {
+		return ErrBufferPoolFull
 	}
-	if !ptb.available() {
-		// TODO unpinされるまで待つ実装でいつか置き換える
-		panic(errors.New("no space in buffer pool"))
-	}
-	for {
-		dropBlkNum := ptb.queue.Pop()
-		dropBuffId := ptb.table[int(dropBlkNum)]
-		if ptb.bm.isPinned(dropBuffId) {
-			ptb.queue.Push(dropBlkNum)
-		} else {
-			if ptb.bm.isRefed(dropBuffId) {
-				ptb.bm.unRef(dropBuffId)
-				ptb.queue.Push(dropBlkNum)
-			} else {
-				delete(ptb.table, int(dropBlkNum))
-				ptb.bm.flush(dropBuffId)
-				break
-			}
+	if err := ptb.bm.flush(ptb.table[dropBlkNum]); err != nil {
+		return err
+	}
+	delete(ptb.table, dropBlkNum)
+	delete(ptb.cold, dropBlkNum)
+	ptb.rp.evicted(dropBlkNum)
+	ptb.stats.Evictions++
+	return nil
+}
+
+// waitAvailable waits until a page is unpinned if all the pages are pinned.
+// ptb.mu is released while waiting.
+func (ptb *PageTable) waitAvailable() error {
+	if ptb.available() {
+		return nil
+	}
+	timer := time.NewTimer(ptb.timeout)
+	defer timer.Stop()
+	for !ptb.available() {
+		if ptb.unpinned == nil {
+			ptb.unpinned = make(chan struct{})
+		}
+		unpinned := ptb.unpinned
+		ptb.mu.Unlock()
+		select {
+		case <-unpinned:
+			ptb.mu.Lock()
+		case <-timer.C:
+			ptb.mu.Lock()
+			return ErrBufferPoolFull
 		}
 	}
+	return nil
 }
 
-func (ptb *PageTable) getBuffId(blk BlockId) int {
-	buffId, exists := ptb.table[int(blk.BlockNum)]
-	if exists {
-		return buffId
-	} else {
-		ptb.makeSpace()
-		ptb.queue.Push(int(blk.BlockNum))
-		buffId := ptb.bm.load(blk)
-		ptb.table[int(blk.BlockNum)] = buffId
-		return buffId
+// getBuffId returns the frame of blk, reading the page if it is not in the buffer pool.
+// A non-nil ring is the access strategy of a scan.
+func (ptb *PageTable) getBuffId(blk BlockId, ring *bufferRing) (int, error) {
+	if buffId, exists := ptb.table[int(blk.BlockNum)]; exists {
+		ptb.hit(int(blk.BlockNum), ring)
+		return buffId, nil
+	}
+	if ring != nil {
+		if err := ptb.recycle(ring); err != nil {
+			return 0, err
+		}
+	}
+	if err := ptb.makeSpace(); err != nil {
+		return 0, err
+	}
+	// 空きを待っている間に他で読み込まれていることがある
+	if buffId, exists := ptb.table[int(blk.BlockNum)]; exists {
+		ptb.hit(int(blk.BlockNum), ring)
+		return buffId, nil
+	}
+	buffId, err := ptb.bm.load(blk)
+	if err != nil {
+		return 0, err
+	}
+	ptb.stats.Misses++
+	ptb.rp.loaded(int(blk.BlockNum))
+	ptb.table[int(blk.BlockNum)] = buffId
+	if ring != nil {
+		ring.blks = append(ring.blks, int(blk.BlockNum))
+		ptb.cold[int(blk.BlockNum)] = true
+	}
+	return buffId, nil
+}
+
+func (ptb *PageTable) hit(blkNum int, ring *bufferRing) {
+	ptb.stats.Hits++
+	// 走査で読んだだけでは追い出されにくくしない
+	if ring == nil {
+		ptb.rp.accessed(blkNum)
+		delete(ptb.cold, blkNum)
 	}
 }
 
 func (ptb *PageTable) available() bool {
-	return ptb.numOfPin != MaxBufferPoolSize
+	return ptb.numOfPin != ptb.bm.size()
 }
 
-func (ptb *PageTable) set(blk BlockId, pg *Page) {
-	ptb.makeSpace()
-	ptb.queue.Push(int(blk.BlockNum))
+// set puts the new page pg of blk in the buffer pool, latched exclusively.
+// The caller releases it with unlatch after filling it.
+func (ptb *PageTable) set(blk BlockId, pg *Page) error {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
+	if err := ptb.makeSpace(); err != nil {
+		return err
+	}
 	buff := newBufferFromPage(blk, pg)
-	buffId := ptb.bm.allocate(buff)
+	buffId, err := ptb.bm.allocate(buff)
+	if err != nil {
+		return err
+	}
+	ptb.rp.loaded(int(blk.BlockNum))
 	ptb.table[int(blk.BlockNum)] = buffId
+	ptb.bm.pin(buffId)
+	ptb.numOfPin++
+	// 誰からも見えていないので待たずに取れる
+	buff.latch.Lock()
+	return nil
+}
+
+func (ptb *PageTable) pageSize() uint32 {
+	return ptb.bm.fm.PageSize()
 }
 
-func (ptb *PageTable) read(blk BlockId) *Page {
-	return ptb.bm.pageAt(ptb.getBuffId(blk))
+// discard drops the page of blk from the buffer pool without writing it back.
+func (ptb *PageTable) discard(blk BlockId) {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
+	buffId, exists := ptb.table[int(blk.BlockNum)]
+	if !exists {
+		return
+	}
+	if ptb.bm.isPinned(buffId) {
+		panic(errors.New("cannot discard pinned page"))
+	}
+	delete(ptb.table, int(blk.BlockNum))
+	delete(ptb.cold, int(blk.BlockNum))
+	ptb.rp.removed(int(blk.BlockNum))
+	ptb.bm.clear(buffId)
 }
 
-func (ptb *PageTable) pin(blk BlockId) *Page {
-	buffId := ptb.getBuffId(blk)
+func (ptb *PageTable) pin(blk BlockId, ring *bufferRing) (*Buffer, error) {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
+	buffId, err := ptb.getBuffId(blk, ring)
+	if err != nil {
+		return nil, err
+	}
+	// numOfPinはpinされているフレームの数
+	if !ptb.bm.isPinned(buffId) {
+		ptb.numOfPin++
+	}
 	ptb.bm.pin(buffId)
-	ptb.numOfPin++
-	return ptb.bm.pageAt(buffId)
+	return ptb.bm.pool[buffId], nil
+}
+
+// latch pins the page of blk and latches its frame in mode.
+// The page must not be used after it is released with unlatch.
+func (ptb *PageTable) latch(blk BlockId, mode latchMode) (*Page, error) {
+	return ptb.latchWith(blk, mode, nil)
+}
+
+// latchWith is latch reading the page through ring, if not nil.
+func (ptb *PageTable) latchWith(blk BlockId, mode latchMode, ring *bufferRing) (*Page, error) {
+	buff, err := ptb.pin(blk, ring)
+	if err != nil {
+		return nil, err
+	}
+	if mode == latchExclusive {
+		buff.latch.Lock()
+	} else {
+		buff.latch.RLock()
+	}
+	return buff.page(), nil
+}
+
+func (ptb *PageTable) unlatch(blk BlockId, mode latchMode) {
+	ptb.mu.Lock()
+	buffId, exists := ptb.table[int(blk.BlockNum)]
+	if !exists {
+		panic(errors.New("trying to unlatch page not in buffer pool"))
+	}
+	buff := ptb.bm.pool[buffId]
+	ptb.mu.Unlock()
+	if mode == latchExclusive {
+		buff.latch.Unlock()
+	} else {
+		buff.latch.RUnlock()
+	}
+	ptb.unpin(blk)
 }
 
 func (ptb *PageTable) unpin(blk BlockId) {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
 	buffId, exists := ptb.table[int(blk.BlockNum)]
 	if !exists {
 		panic(errors.New("trying to unpin page not on disk"))
 	}
 	ptb.bm.unpin(buffId)
+	if ptb.bm.isPinned(buffId) {
+		return
+	}
 	ptb.numOfPin--
+	if ptb.unpinned != nil {
+		close(ptb.unpinned)
+		ptb.unpinned = nil
+	}
+}
+
+// Pin keeps the page of blk in the buffer pool until Unpin is called.
+func (ptb *PageTable) Pin(blk BlockId) error {
+	_, err := ptb.pin(blk, nil)
+	return err
 }
 
-func (ptb *PageTable) GetPageLSN(blk BlockId) uint32 {
-	buffId := ptb.getBuffId(blk)
-	return ptb.bm.pageAt(buffId).header.pageLSN
+func (ptb *PageTable) Unpin(blk BlockId) {
+	ptb.unpin(blk)
 }
 
-func (ptb *PageTable) SetPageLSN(blk BlockId, lsn uint32) {
-	buffId := ptb.getBuffId(blk)
-	ptb.bm.pageAt(buffId).header.pageLSN = lsn
+func (ptb *PageTable) GetPageLSN(blk BlockId) (uint32, error) {
+	pg, err := ptb.latch(blk, latchShared)
+	if err != nil {
+		return 0, err
+	}
+	defer ptb.unlatch(blk, latchShared)
+	return pg.header.pageLSN, nil
+}
+
+func (ptb *PageTable) SetPageLSN(blk BlockId, lsn uint32) error {
+	pg, err := ptb.latch(blk, latchExclusive)
+	if err != nil {
+		return err
+	}
+	defer ptb.unlatch(blk, latchExclusive)
+	pg.header.pageLSN = lsn
+	pg.dirty = true
+	return nil
 }
 
 func (ptb *PageTable) Print() {
+	ptb.mu.Lock()
+	defer ptb.mu.Unlock()
 	fmt.Printf("Print Page table {\n")
 	fmt.Printf("table %v\n", ptb.table)
-	fmt.Printf("queue [ ")
-	ptb.queue.Print()
-	fmt.Printf(" ]\n")
+	fmt.Printf("policy %v, %v\n", ptb.policy, ptb.stats)
 	fmt.Printf("NumOfPins {%d}\n", ptb.numOfPin)
 	ptb.bm.Print()
 	fmt.Printf("}\n")
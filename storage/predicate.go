@@ -0,0 +1,179 @@
+package storage
+
+import "errors"
+
+var ErrColumnNotFound = errors.New("column not found")
+
+// Predicate is a boolean expression over the columns of a record.
+// It follows SQL's three-valued logic: a comparison with NULL is unknown,
+// and a record matches only if the predicate is true.
+type Predicate interface {
+	// bind resolves column names and constants against cols once per query.
+	bind(cols []Column) (func(row []interface{}) truth, error)
+}
+
+// truth is a value of three-valued logic.
+// false < unknown < true と並べると、ANDは最小、ORは最大、NOTは反転になる
+type truth int
+
+const (
+	truthFalse truth = iota
+	truthUnknown
+	truthTrue
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return truthTrue
+	}
+	return truthFalse
+}
+
+type compareOp int
+
+const (
+	opEq compareOp = iota
+	opNe
+	opLt
+	opLe
+	opGt
+	opGe
+)
+
+type comparison struct {
+	name string
+	op   compareOp
+	val  interface{}
+}
+
+func Eq(name string, val interface{}) Predicate { return comparison{name, opEq, val} }
+func Ne(name string, val interface{}) Predicate { return comparison{name, opNe, val} }
+func Lt(name string, val interface{}) Predicate { return comparison{name, opLt, val} }
+func Le(name string, val interface{}) Predicate { return comparison{name, opLe, val} }
+func Gt(name string, val interface{}) Predicate { return comparison{name, opGt, val} }
+func Ge(name string, val interface{}) Predicate { return comparison{name, opGe, val} }
+
+func (c comparison) bind(cols []Column) (func(row []interface{}) truth, error) {
+	idx := -1
+	for i, col := range cols {
+		if col.name == c.name {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		return nil, ErrColumnNotFound
+	}
+	col := cols[idx]
+	// 定数をカラムの型に揃えておく
+	bytes, err := encodeValue(col, c.val)
+	if err != nil {
+		return nil, err
+	}
+	val := decodeValue(col, bytes)
+	return func(row []interface{}) truth {
+		// NULLとの比較はunknown
+		if row[idx] == nil {
+			return truthUnknown
+		}
+		res := compareValue(col.ty, row[idx], val)
+		switch c.op {
+		case opEq:
+			return truthOf(res == 0)
+		case opNe:
+			return truthOf(res != 0)
+		case opLt:
+			return truthOf(res < 0)
+		case opLe:
+			return truthOf(res <= 0)
+		case opGt:
+			return truthOf(res > 0)
+		default:
+			return truthOf(res >= 0)
+		}
+	}, nil
+}
+
+type isNull struct {
+	name string
+	want bool
+}
+
+func IsNull(name string) Predicate    { return isNull{name, true} }
+func IsNotNull(name string) Predicate { return isNull{name, false} }
+
+func (n isNull) bind(cols []Column) (func(row []interface{}) truth, error) {
+	for i, col := range cols {
+		if col.name == n.name {
+			return func(row []interface{}) truth {
+				return truthOf((row[i] == nil) == n.want)
+			}, nil
+		}
+	}
+	return nil, ErrColumnNotFound
+}
+
+type and []Predicate
+type or []Predicate
+type not struct{ pred Predicate }
+
+func And(preds ...Predicate) Predicate { return and(preds) }
+func Or(preds ...Predicate) Predicate  { return or(preds) }
+func Not(pred Predicate) Predicate     { return not{pred} }
+
+func bindAll(preds []Predicate, cols []Column) ([]func(row []interface{}) truth, error) {
+	fns := make([]func(row []interface{}) truth, len(preds))
+	for i, pred := range preds {
+		fn, err := pred.bind(cols)
+		if err != nil {
+			return nil, err
+		}
+		fns[i] = fn
+	}
+	return fns, nil
+}
+
+func (preds and) bind(cols []Column) (func(row []interface{}) truth, error) {
+	fns, err := bindAll(preds, cols)
+	if err != nil {
+		return nil, err
+	}
+	return func(row []interface{}) truth {
+		res := truthTrue
+		for _, fn := range fns {
+			if t := fn(row); t == truthFalse {
+				return t
+			} else if t < res {
+				res = t
+			}
+		}
+		return res
+	}, nil
+}
+
+func (preds or) bind(cols []Column) (func(row []interface{}) truth, error) {
+	fns, err := bindAll(preds, cols)
+	if err != nil {
+		return nil, err
+	}
+	return func(row []interface{}) truth {
+		res := truthFalse
+		for _, fn := range fns {
+			if t := fn(row); t == truthTrue {
+				return t
+			} else if t > res {
+				res = t
+			}
+		}
+		return res
+	}, nil
+}
+
+func (n not) bind(cols []Column) (func(row []interface{}) truth, error) {
+	fn, err := n.pred.bind(cols)
+	if err != nil {
+		return nil, err
+	}
+	return func(row []interface{}) truth {
+		return truthTrue - fn(row)
+	}, nil
+}
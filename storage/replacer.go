@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+
+	"github.com/tychyDB/algorithm"
+)
+
+// ReplacementPolicy decides which page is evicted when the buffer pool is full.
+type ReplacementPolicy int
+
+const (
+	// ClockReplacement gives pages referenced since the last sweep a second chance.
+	ClockReplacement ReplacementPolicy = iota
+	// LRUReplacement evicts the least recently used page.
+	LRUReplacement
+	// LRUKReplacement evicts the page whose K-th most recent access is the oldest (K = 2).
+	// Pages accessed less than K times are evicted first, so a scan doesn't push out frequently used pages.
+	LRUKReplacement
+	// TwoQReplacement keeps pages accessed once in a FIFO queue and promotes pages accessed again
+	// to an LRU queue. Pages evicted from the FIFO queue are remembered for a while
+	// so that they are promoted when read again.
+	TwoQReplacement
+)
+
+var ErrInvalidReplacement = errors.New("unknown replacement policy")
+
+func (policy ReplacementPolicy) String() string {
+	switch policy {
+	case ClockReplacement:
+		return "Clock"
+	case LRUReplacement:
+		return "LRU"
+	case LRUKReplacement:
+		return "LRU-K"
+	case TwoQReplacement:
+		return "2Q"
+	}
+	return fmt.Sprintf("ReplacementPolicy(%d)", int(policy))
+}
+
+// replacer keeps track of the accesses to the pages in the buffer pool
+// and picks the page to evict. Pages are identified by their block numbers.
+type replacer interface {
+	// loaded is called when a page is put in the buffer pool.
+	loaded(blkNum int)
+	// accessed is called when a page in the buffer pool is used again.
+	accessed(blkNum int)
+	// victim returns the page to evict among the pages for which evictable returns true.
+	// The page stays tracked until evicted is called.
+	victim(evictable func(blkNum int) bool) (int, bool)
+	// evicted is called when the page returned by victim has left the buffer pool.
+	evicted(blkNum int)
+	// removed is called when a page leaves the buffer pool without being chosen by victim.
+	removed(blkNum int)
+}
+
+func newReplacer(policy ReplacementPolicy, size int) (replacer, error) {
+	switch policy {
+	case ClockReplacement:
+		return newClockReplacer(), nil
+	case LRUReplacement:
+		return newLRUReplacer(), nil
+	case LRUKReplacement:
+		return newLRUKReplacer(lruK), nil
+	case TwoQReplacement:
+		return newTwoQReplacer(size), nil
+	}
+	return nil, ErrInvalidReplacement
+}
+
+type clockReplacer struct {
+	queue algorithm.Queue
+	ref   map[int]bool
+}
+
+func newClockReplacer() *clockReplacer {
+	return &clockReplacer{queue: algorithm.NewQueue(64), ref: make(map[int]bool)}
+}
+
+func (r *clockReplacer) loaded(blkNum int) {
+	r.queue.Push(blkNum)
+	r.ref[blkNum] = false
+}
+
+func (r *clockReplacer) accessed(blkNum int) {
+	r.ref[blkNum] = true
+}
+
+func (r *clockReplacer) victim(evictable func(int) bool) (int, bool) {
+	// 全てのページのrefを落とすには2周する必要がある
+	for i := 0; i < 2*r.queue.Size(); i++ {
+		blkNum := r.queue.Pop()
+		r.queue.Push(blkNum)
+		if !evictable(blkNum) {
+			continue
+		}
+		if r.ref[blkNum] {
+			r.ref[blkNum] = false
+			continue
+		}
+		return blkNum, true
+	}
+	return 0, false
+}
+
+func (r *clockReplacer) evicted(blkNum int) {
+	r.removed(blkNum)
+}
+
+func (r *clockReplacer) removed(blkNum int) {
+	r.queue.Remove(blkNum)
+	delete(r.ref, blkNum)
+}
+
+// lruList orders pages from the most recently used one at the front.
+type lruList struct {
+	list  *list.List
+	elems map[int]*list.Element
+}
+
+func newLRUList() lruList {
+	return lruList{list: list.New(), elems: make(map[int]*list.Element)}
+}
+
+func (l lruList) len() int {
+	return l.list.Len()
+}
+
+func (l lruList) contains(blkNum int) bool {
+	_, exists := l.elems[blkNum]
+	return exists
+}
+
+func (l lruList) pushFront(blkNum int) {
+	l.elems[blkNum] = l.list.PushFront(blkNum)
+}
+
+func (l lruList) moveToFront(blkNum int) {
+	l.list.MoveToFront(l.elems[blkNum])
+}
+
+func (l lruList) remove(blkNum int) bool {
+	e, exists := l.elems[blkNum]
+	if !exists {
+		return false
+	}
+	l.list.Remove(e)
+	delete(l.elems, blkNum)
+	return true
+}
+
+// back returns the least recently used page for which evictable returns true.
+func (l lruList) back(evictable func(int) bool) (int, bool) {
+	for e := l.list.Back(); e != nil; e = e.Prev() {
+		if blkNum := e.Value.(int); evictable(blkNum) {
+			return blkNum, true
+		}
+	}
+	return 0, false
+}
+
+type lruReplacer struct {
+	pages lruList
+}
+
+func newLRUReplacer() *lruReplacer {
+	return &lruReplacer{pages: newLRUList()}
+}
+
+func (r *lruReplacer) loaded(blkNum int) {
+	r.pages.pushFront(blkNum)
+}
+
+func (r *lruReplacer) accessed(blkNum int) {
+	r.pages.moveToFront(blkNum)
+}
+
+func (r *lruReplacer) victim(evictable func(int) bool) (int, bool) {
+	return r.pages.back(evictable)
+}
+
+func (r *lruReplacer) evicted(blkNum int) {
+	r.pages.remove(blkNum)
+}
+
+func (r *lruReplacer) removed(blkNum int) {
+	r.pages.remove(blkNum)
+}
+
+const lruK = 2
+
+// lruKReplacer keeps the times of the last k accesses of the pages in the buffer pool.
+// 追い出されたページの履歴は保持しない
+type lruKReplacer struct {
+	k       int
+	now     uint64
+	history map[int][]uint64 // 古いアクセスから順に最大k個
+}
+
+func newLRUKReplacer(k int) *lruKReplacer {
+	return &lruKReplacer{k: k, history: make(map[int][]uint64)}
+}
+
+func (r *lruKReplacer) loaded(blkNum int) {
+	r.history[blkNum] = nil
+	r.accessed(blkNum)
+}
+
+func (r *lruKReplacer) accessed(blkNum int) {
+	r.now++
+	h := append(r.history[blkNum], r.now)
+	if len(h) > r.k {
+		h = h[1:]
+	}
+	r.history[blkNum] = h
+}
+
+func (r *lruKReplacer) victim(evictable func(int) bool) (int, bool) {
+	// アクセスがk回未満のページを優先し、その中では最初のアクセスが古いものを選ぶ
+	// k回以上なら、k回前のアクセスが最も古いものを選ぶ
+	found := false
+	var victim int
+	var victimFew bool
+	var victimTime uint64
+	for blkNum, h := range r.history {
+		if !evictable(blkNum) {
+			continue
+		}
+		few := len(h) < r.k
+		if !found || few && !victimFew || few == victimFew && h[0] < victimTime {
+			found, victim, victimFew, victimTime = true, blkNum, few, h[0]
+		}
+	}
+	return victim, found
+}
+
+func (r *lruKReplacer) evicted(blkNum int) {
+	delete(r.history, blkNum)
+}
+
+func (r *lruKReplacer) removed(blkNum int) {
+	delete(r.history, blkNum)
+}
+
+// twoQReplacer is the full version of 2Q by Johnson and Shasha.
+// a1inは1回だけ読まれたページのFIFO、amは再び使われたページのLRU、
+// a1outはa1inから追い出されたページの番号だけを覚えておくFIFO
+type twoQReplacer struct {
+	kin   int
+	kout  int
+	a1in  lruList
+	am    lruList
+	a1out lruList
+}
+
+func newTwoQReplacer(size int) *twoQReplacer {
+	r := &twoQReplacer{a1in: newLRUList(), am: newLRUList(), a1out: newLRUList()}
+	r.kin = size / 4
+	if r.kin < 1 {
+		r.kin = 1
+	}
+	r.kout = size / 2
+	if r.kout < 1 {
+		r.kout = 1
+	}
+	return r
+}
+
+func (r *twoQReplacer) loaded(blkNum int) {
+	if r.a1out.remove(blkNum) {
+		r.am.pushFront(blkNum)
+		return
+	}
+	r.a1in.pushFront(blkNum)
+}
+
+func (r *twoQReplacer) accessed(blkNum int) {
+	// a1inにあるページへの短い間隔のアクセスは数えない
+	if r.am.contains(blkNum) {
+		r.am.moveToFront(blkNum)
+	}
+}
+
+func (r *twoQReplacer) victim(evictable func(int) bool) (int, bool) {
+	first, second := r.am, r.a1in
+	if r.a1in.len() > r.kin || r.am.len() == 0 {
+		first, second = r.a1in, r.am
+	}
+	if blkNum, ok := first.back(evictable); ok {
+		return blkNum, true
+	}
+	return second.back(evictable)
+}
+
+func (r *twoQReplacer) evicted(blkNum int) {
+	if r.a1in.remove(blkNum) {
+		r.a1out.pushFront(blkNum)
+		if r.a1out.len() > r.kout {
+			oldest, _ := r.a1out.back(func(int) bool { return true })
+			r.a1out.remove(oldest)
+		}
+		return
+	}
+	r.am.remove(blkNum)
+}
+
+func (r *twoQReplacer) removed(blkNum int) {
+	if !r.a1in.remove(blkNum) {
+		r.am.remove(blkNum)
+	}
+}
+
+// BufferStats counts the lookups of pages in the buffer pool.
+type BufferStats struct {
+	Hits      uint64 // バッファプールにあったページ
+	Misses    uint64 // ファイルから読んだページ
+	Evictions uint64 // 空きを作るために追い出したページ
+}
+
+func (stats BufferStats) String() string {
+	return fmt.Sprintf("hits %d, misses %d, evictions %d", stats.Hits, stats.Misses, stats.Evictions)
+}
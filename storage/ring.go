@@ -0,0 +1,46 @@
+package storage
+
+// minRingSize is the smallest number of frames given to a ring.
+// 木をたどる走査は親と子を同時にpinするので2つは必要
+const minRingSize = 2
+
+// bufferRing is the access strategy of full scans and bulk operations.
+// The pages such an operation reads into the buffer pool are recycled within a ring of
+// a few frames, so that one scan doesn't push out the pages used by point lookups.
+// Pages already in the buffer pool are used as they are, but not counted as accessed
+// by the replacement policy.
+type bufferRing struct {
+	size int
+	blks []int // リングに読み込んだページ。古い順
+}
+
+// newRing returns a ring using 1/8 of the buffer pool.
+func (ptb *PageTable) newRing() *bufferRing {
+	size := ptb.bm.size() / 8
+	if size < minRingSize {
+		size = minRingSize
+	}
+	return &bufferRing{size: size}
+}
+
+// recycle evicts the oldest page of the ring to make room for a new one when the ring is full.
+// Pages pinned or used by other operations since they were read are left in the buffer pool
+// and just leave the ring. Called with ptb.mu held.
+func (ptb *PageTable) recycle(ring *bufferRing) error {
+	for len(ring.blks) >= ring.size {
+		blkNum := ring.blks[0]
+		ring.blks = ring.blks[1:]
+		buffId, exists := ptb.table[blkNum]
+		if !exists || !ptb.cold[blkNum] || ptb.bm.isPinned(buffId) {
+			continue
+		}
+		if err := ptb.bm.flush(buffId); err != nil {
+			return err
+		}
+		delete(ptb.table, blkNum)
+		delete(ptb.cold, blkNum)
+		ptb.rp.removed(blkNum)
+		ptb.stats.Evictions++
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Rows iterates over the records of a table in primary key order.
+// Each record is decoded once, filtered by the predicate and projected to the selected columns.
+type Rows struct {
+	cur   rowSource
+	names []string
+	proj  []int
+	pred  func(row []interface{}) truth
+	row   []interface{}
+}
+
+type rowSource interface {
+	Next() bool
+	Values() []interface{}
+	Err() error
+}
+
+// Rows returns the records satisfying pred projected to the columns of names.
+// A nil pred matches every record.
+func (st *Storage) Rows(pred Predicate, names ...string) (*Rows, error) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	rows := &Rows{names: names}
+	rows.proj = make([]int, len(names))
+	for i, name := range names {
+		idx := st.columnIndex(name)
+		if idx == -1 {
+			return nil, ErrColumnNotFound
+		}
+		rows.proj[i] = idx
+	}
+	if pred != nil {
+		fn, err := pred.bind(st.cols)
+		if err != nil {
+			return nil, err
+		}
+		rows.pred = fn
+		// 等号の条件にインデックスが使えるなら全件は読まない
+		src, err := st.indexSource(pred)
+		if err != nil {
+			return nil, err
+		}
+		if src != nil {
+			src.share()
+			rows.cur = src
+			return rows, nil
+		}
+	}
+	cur, err := st.scan(nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	cur.share()
+	rows.cur = cur
+	return rows, nil
+}
+
+func (rows *Rows) Columns() []string {
+	return rows.names
+}
+
+func (rows *Rows) Next() bool {
+	for rows.cur.Next() {
+		row := rows.cur.Values()
+		if row == nil {
+			break
+		}
+		if rows.pred != nil && rows.pred(row) != truthTrue {
+			continue
+		}
+		rows.row = make([]interface{}, len(rows.proj))
+		for i, idx := range rows.proj {
+			rows.row[i] = row[idx]
+		}
+		return true
+	}
+	rows.row = nil
+	return false
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (rows *Rows) Err() error {
+	return rows.cur.Err()
+}
+
+// Values returns the projected values of the current record.
+func (rows *Rows) Values() []interface{} {
+	return rows.row
+}
+
+// Scan copies the projected values of the current record into dest.
+// Each dest must be a pointer to a Go type of the column, or to interface{}.
+func (rows *Rows) Scan(dest ...interface{}) error {
+	if rows.row == nil {
+		return errors.New("scan called without calling Next")
+	}
+	if len(dest) != len(rows.row) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(rows.row), len(dest))
+	}
+	for i, val := range rows.row {
+		if err := assignValue(dest[i], val); err != nil {
+			return fmt.Errorf("column %s: %w", rows.names[i], err)
+		}
+	}
+	return nil
+}
+
+func assignValue(dest, val interface{}) error {
+	switch d := dest.(type) {
+	case *interface{}:
+		*d = val
+		return nil
+	case *int:
+		switch v := val.(type) {
+		case int32:
+			*d = int(v)
+			return nil
+		case int64:
+			*d = int(v)
+			return nil
+		}
+	case *int64:
+		switch v := val.(type) {
+		case int32:
+			*d = int64(v)
+			return nil
+		case int64:
+			*d = v
+			return nil
+		}
+	case *int32:
+		if v, ok := val.(int32); ok {
+			*d = v
+			return nil
+		}
+	case *string:
+		if v, ok := val.(string); ok {
+			*d = v
+			return nil
+		}
+	case *[]byte:
+		if v, ok := val.([]byte); ok {
+			*d = v
+			return nil
+		}
+	case *bool:
+		if v, ok := val.(bool); ok {
+			*d = v
+			return nil
+		}
+	case *float64:
+		if v, ok := val.(float64); ok {
+			*d = v
+			return nil
+		}
+	case *time.Time:
+		if v, ok := val.(time.Time); ok {
+			*d = v
+			return nil
+		}
+	case *Decimal:
+		if v, ok := val.(Decimal); ok {
+			*d = v
+			return nil
+		}
+	}
+	return ErrTypeMismatch
+}
@@ -0,0 +1,228 @@
+package storage
+
+import "errors"
+
+var (
+	ErrColumnExists = errors.New("column already exists")
+	ErrKeyColumn    = errors.New("cannot alter primary key column")
+)
+
+// AddColumnWithDefault adds a column to the table, which may already have records.
+// The records written before it read def, nil meaning NULL.
+func (st *Storage) AddColumnWithDefault(name string, ty Type, def interface{}, opts ...ColumnOption) error {
+	st.lock()
+	defer st.unlock()
+	if st.columnIndex(name) != -1 {
+		return ErrColumnExists
+	}
+	col := Column{id: st.nextColId, ty: ty, name: name}
+	for _, opt := range opts {
+		col.opts |= opt
+	}
+	// 空のテーブルならNOT NULLのカラムに既定値はいらない
+	if def == nil && col.isNotNull() {
+		if empty, err := st.isEmpty(); err != nil {
+			return err
+		} else if !empty {
+			return ErrNotNull
+		}
+	}
+	buf := []byte{}
+	if def != nil {
+		var err error
+		if buf, err = encodeValue(col, def); err != nil {
+			return err
+		}
+	}
+	// 既定値はレコードごとに埋め込むので、オーバーフローさせない
+	if len(buf) > 0 && isOverflow(col, uint32(len(buf))-IntSize) {
+		return ErrStringTooLong
+	}
+	col.def = buf
+	cols := make([]Column, len(st.cols), len(st.cols)+1)
+	copy(cols, st.cols)
+	if err := st.alter(append(cols, col)); err != nil {
+		return err
+	}
+	st.nextColId++
+	return nil
+}
+
+// DropColumn removes a column from the table. Primary key columns cannot be dropped.
+func (st *Storage) DropColumn(name string) error {
+	st.lock()
+	defer st.unlock()
+	idx := st.columnIndex(name)
+	if idx == -1 {
+		return ErrColumnNotFound
+	}
+	if st.isKeyColumn(idx) {
+		return ErrKeyColumn
+	}
+	if st.isIndexedColumn(idx) {
+		return ErrIndexedColumn
+	}
+	cols := make([]Column, 0, len(st.cols)-1)
+	cols = append(cols, st.cols[:idx]...)
+	cols = append(cols, st.cols[idx+1:]...)
+	if err := st.alter(cols); err != nil {
+		return err
+	}
+	for i, k := range st.keys {
+		if int(k) > idx {
+			st.keys[i]--
+		}
+	}
+	return nil
+}
+
+// RenameColumn renames a column. Records are not touched since columns are identified by id.
+func (st *Storage) RenameColumn(name string, newName string) error {
+	st.lock()
+	defer st.unlock()
+	idx := st.columnIndex(name)
+	if idx == -1 {
+		return ErrColumnNotFound
+	}
+	if st.columnIndex(newName) != -1 {
+		return ErrColumnExists
+	}
+	cols := make([]Column, len(st.cols))
+	copy(cols, st.cols)
+	cols[idx].name = newName
+	return st.updateMeta(func(pg MetaPage) MetaPage {
+		pg.cols = cols
+		return pg
+	})
+}
+
+// alter replaces the columns of the table and lays them out again.
+// 現在のバージョンで書かれたレコードがあるときだけバージョンを上げ、古いカラムは履歴に残す
+func (st *Storage) alter(cols []Column) error {
+	var pos uint32
+	for i := range cols {
+		cols[i].pos = pos
+		pos += cols[i].Size()
+	}
+	return st.updateMeta(func(pg MetaPage) MetaPage {
+		if pg.used {
+			pg.history = append(pg.history[:len(pg.history):len(pg.history)], pg.cols)
+			pg.used = false
+		}
+		pg.cols = cols
+		return pg
+	})
+}
+
+// updateMeta replaces the meta page of the table with the one made by change.
+// If it doesn't fit in a page, the versions of the columns no record uses are dropped,
+// and then the records of old versions are rewritten in the current version.
+// ErrMetaFull is returned if it still doesn't fit.
+func (st *Storage) updateMeta(change func(pg MetaPage) MetaPage) error {
+	pageSize := st.fm.PageSize()
+	if next := change(st.MetaPage); next.size() <= pageSize {
+		st.MetaPage = next
+		return nil
+	}
+	// 履歴を全て捨てても入らないなら何も変えない
+	least := st.MetaPage
+	least.history = nil
+	if least = change(least); least.size() > pageSize {
+		return ErrMetaFull
+	}
+	if err := st.pruneHistory(); err != nil {
+		return err
+	}
+	if next := change(st.MetaPage); next.size() <= pageSize {
+		st.MetaPage = next
+		return nil
+	}
+	if err := st.upgradeRecords(); err != nil {
+		return err
+	}
+	if err := st.pruneHistory(); err != nil {
+		return err
+	}
+	st.MetaPage = change(st.MetaPage)
+	return nil
+}
+
+// pruneHistory drops the versions of the columns that no record uses.
+// バージョンの番号はレコードに書かれているので、先頭以外は空の履歴にして番号を保つ
+func (st *Storage) pruneHistory() error {
+	live := make(map[uint32]bool)
+	err := st.tree().walk(latchShared, func(pg *Page) {
+		if !pg.header.isLeaf {
+			return
+		}
+		for _, cell := range pg.entries() {
+			live[cell.(KeyValueCell).rec.version] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for len(st.history) > 0 && !live[st.baseVersion] {
+		st.history = st.history[1:]
+		st.baseVersion++
+	}
+	for i := range st.history {
+		if !live[st.baseVersion+uint32(i)] {
+			st.history[i] = nil
+		}
+	}
+	return nil
+}
+
+// upgradeRecords rewrites the records of old versions in the current version.
+func (st *Storage) upgradeRecords() error {
+	cur, err := st.scan(nil, nil, false)
+	if err != nil {
+		return err
+	}
+	bt := st.tree()
+	for cur.Next() {
+		cell := cur.cur
+		if cell.rec.version == st.version() {
+			continue
+		}
+		rec := st.newRecord(st.upgrade(cell.rec))
+		if err := bt.insert(KeyValueCell{key: cell.key, rec: rec}, true); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (st *Storage) isEmpty() (bool, error) {
+	return st.tree().isEmpty()
+}
+
+// newRecord makes a record of the current version from data encoded with st.cols
+func (st *Storage) newRecord(data []byte) Record {
+	// 共有ラッチで追加するときは既にtrueなので書き込まない
+	if !st.used {
+		st.used = true
+	}
+	return Record{version: st.version(), size: uint32(len(data)), data: data}
+}
+
+// upgrade returns the data of rec laid out for the current columns.
+// 古いバージョンのレコードは読み出すときに変換し、書き換えるときに新しいバージョンで書き直す
+func (st *Storage) upgrade(rec Record) []byte {
+	if rec.version == st.version() {
+		return rec.data
+	}
+	old := st.columnsOf(rec.version)
+	fields := make([]field, len(st.cols))
+	for i, col := range st.cols {
+		// 既定値はオーバーフローしないのでspillは呼ばれない
+		fields[i], _ = toField(col, col.def, nil)
+		for j, c := range old {
+			if c.id == col.id {
+				fields[i] = fieldAt(old, j, rec.data)
+			}
+		}
+	}
+	return buildRecord(st.cols, fields)
+}
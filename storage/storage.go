@@ -1,129 +1,264 @@
 package storage
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
-	"strings"
+	"sync"
 
 	"github.com/tychyDB/algorithm"
-	"github.com/tychyDB/util"
 )
 
 const StorageFile = "storage"
 
-func ResetBlockId() {
-	UniqueBlockId = 0
-}
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrDuplicateKey = errors.New("duplicate primary key")
+)
 
+// Storage is a table. It is safe for concurrent use.
+// Searches, scans and inserts of new records share the table, and the other operations
+// run alone on it.
 type Storage struct {
-	fm  *FileMgr
-	ptb *PageTable
+	fm   *FileMgr
+	ptb  *PageTable
+	cat  *Catalog
+	name string
 	MetaPage
+	latch     *sync.RWMutex // テーブルのラッチ。ページを解放したり動かしたりする操作は排他で取る
+	rootLatch *sync.RWMutex // テーブルとインデックスのrootの付け替えを守る
+	epoch     uint64        // 排他の操作のたびに増える。カーソルが読み直しを判断するのに使う
+}
+
+func newStorage(cat *Catalog, name string) *Storage {
+	st := &Storage{}
+	st.fm = cat.fm
+	st.ptb = cat.ptb
+	st.cat = cat
+	st.name = name
+	st.latch = &sync.RWMutex{}
+	st.rootLatch = &sync.RWMutex{}
+	return st
 }
 
-func NewStorage(fm *FileMgr, ptb *PageTable) Storage {
-	ResetBlockId()
-	st := Storage{}
-	// テーブルのメタ情報を置くためのページ
+// lock takes the table latch exclusively.
+func (st *Storage) lock() {
+	st.latch.Lock()
+}
 
-	metaBlk := newUniqueBlockId(StorageFile)
-	st.metaBlk = metaBlk
-	if metaBlk.BlockNum != 0 {
-		panic(errors.New("place a meta page at the top of the file"))
-	}
-	st.fm = fm
-	st.fm.Write(metaBlk, st.MetaPage.toBytes())
+func (st *Storage) unlock() {
+	st.epoch++
+	st.latch.Unlock()
+}
 
-	st.ptb = ptb
-	// rootノード
-	root := newPage(false)
-	st.rootBlk = newUniqueBlockId(StorageFile)
-	ptb.set(st.rootBlk, root)
-	st.cols = []Column{}
+// NewStorage creates a new storage file holding only DefaultTable
+func NewStorage(fm *FileMgr, ptb *PageTable) *Storage {
+	cat := NewCatalog(fm, ptb)
+	st, err := cat.CreateTable(DefaultTable)
+	if err != nil {
+		panic(err)
+	}
 	return st
 }
 
-func NewStorageFromFile(fm *FileMgr, ptb *PageTable) Storage {
-	ResetBlockId()
-	st := Storage{}
-	st.fm = fm
-	st.ptb = ptb
-	blk := newUniqueBlockId(StorageFile)
-	_, bytes := fm.Read(blk)
-	st.MetaPage = newMetaPageFromBytes(bytes)
+func NewStorageFromFile(fm *FileMgr, ptb *PageTable) *Storage {
+	cat := NewCatalogFromFile(fm, ptb)
+	st, err := cat.OpenTable(DefaultTable)
+	if err != nil {
+		panic(err)
+	}
 	return st
 }
 
-func (st *Storage) Flush() {
-	st.ptb.Flush()
-	st.fm.Write(st.metaBlk, st.MetaPage.toBytes())
+func (st *Storage) Name() string {
+	return st.name
 }
 
-func (st *Storage) Clear() {
+func (st *Storage) Flush() error {
+	if err := st.ptb.Flush(); err != nil {
+		return err
+	}
+	st.latch.RLock()
+	err := st.writeMeta()
+	st.latch.RUnlock()
+	if err != nil {
+		return err
+	}
+	st.cat.mu.Lock()
+	err = st.cat.writePage()
+	st.cat.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return st.fm.Sync(StorageFile)
+}
+
+func (st *Storage) writeMeta() error {
+	bytes, err := st.MetaPage.toBytes(st.fm.PageSize())
+	if err != nil {
+		return err
+	}
+	return st.fm.Write(st.metaBlk, bytes)
+}
+
+func (st *Storage) Clear() error {
+	// カタログのロックはテーブルのラッチより先に取る
+	st.cat.mu.Lock()
+	err := st.cat.load()
+	st.cat.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	st.lock()
+	defer st.unlock()
 	st.ptb.ClearBuffer()
-	_, bytes := st.fm.Read(NewBlockId(0, StorageFile))
-	st.MetaPage = newMetaPageFromBytes(bytes)
-}
-
-func (st *Storage) addRecord(rec Record) {
-	rootPage := st.ptb.pin(st.rootBlk)
-	if rootPage.header.numOfPtr == 0 {
-		pg := newPage(true)
-		blk := newUniqueBlockId(StorageFile)
-		st.ptb.set(blk, pg)
-		rootPage.cells = append(rootPage.cells, KeyCell{key: math.MaxInt32, pageIndex: blk.BlockNum})
-		rootPage.header.rightmostPtr = 0
-		rootPage.header.numOfPtr++
-		pg.ptrs = append(pg.ptrs, 0)
-		pg.cells = append(pg.cells, KeyValueCell{key: rec.getKey(), rec: rec})
-		pg.header.numOfPtr++
-		st.ptb.unpin(st.rootBlk)
-	} else {
-		splitted, splitKey, leftPageIndex := rootPage.addRecordRec(st.ptb, rec)
-		if splitted {
-			newRootPage := newPage(false)
-			blk := newUniqueBlockId(StorageFile)
-			st.ptb.set(blk, newRootPage)
-			st.ptb.pin(blk)
-			newRootPage.header.rightmostPtr = 0
-			newRootPage.ptrs = append(newRootPage.ptrs, 1)
-			newRootPage.cells = append(newRootPage.cells, KeyCell{key: math.MaxInt32, pageIndex: st.rootBlk.BlockNum})
-			newRootPage.cells = append(newRootPage.cells, KeyCell{key: splitKey, pageIndex: leftPageIndex})
-			newRootPage.header.numOfPtr += 2
-			st.rootBlk = blk
+	meta, err := readMeta(st.fm, st.metaBlk)
+	if err != nil {
+		return err
+	}
+	st.MetaPage = meta
+	return nil
+}
+
+func (st *Storage) tree() *btree {
+	return &btree{ptb: st.ptb, alloc: st.cat.alloc, root: &st.rootBlk, rootLatch: st.rootLatch, cmp: st.comparator(), limit: st.pageLimit()}
+}
+
+// addRecord inserts rec into the table. If rec is not inserted, its overflow chains are freed.
+func (st *Storage) addRecord(rec Record, replace bool) error {
+	key, err := st.keyOf(rec)
+	if err != nil {
+		return st.abandon(rec, nil, err)
+	}
+	var row, old []interface{}
+	if len(st.indexes) > 0 {
+		if row, err = st.decodeRecord(rec); err != nil {
+			return st.abandon(rec, nil, err)
+		}
+		if err := st.checkIndexes(row, key); err != nil {
+			return st.abandon(rec, nil, err)
+		}
+	}
+	var oldRec Record
+	found := false
+	if replace {
+		if oldRec, found, err = st.recordByKey(key); err != nil {
+			return st.abandon(rec, nil, err)
+		}
+		if found && len(st.indexes) > 0 {
+			if old, err = st.decodeRecord(oldRec); err != nil {
+				return st.abandon(rec, nil, err)
+			}
 		}
-		st.ptb.unpin(st.rootBlk)
 	}
+	if err := st.tree().insert(KeyValueCell{key: key, rec: rec}, replace); err != nil {
+		return st.abandon(rec, nil, err)
+	}
+	if found {
+		if err := st.releaseOverflow(oldRec, st.overflowHeads(rec)); err != nil {
+			return err
+		}
+	}
+	if len(st.indexes) > 0 {
+		return st.reindex(old, row, key)
+	}
+	return nil
 }
 
-func (st *Storage) AddColumn(name string, ty Type) {
-	var pos uint32
-	if st.ColumnLength() == 0 {
-		pos = 0
-	} else {
-		last := st.cols[st.ColumnLength()-1]
-		pos = last.pos + last.Size()
+func (st *Storage) Delete(prVal interface{}) error {
+	st.lock()
+	defer st.unlock()
+	prKey, err := st.primaryKey(prVal)
+	if err != nil {
+		return err
+	}
+	rec, found, err := st.recordByKey(prKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	var old []interface{}
+	if len(st.indexes) > 0 {
+		if old, err = st.decodeRecord(rec); err != nil {
+			return err
+		}
+	}
+	if err := st.tree().delete(prKey); err != nil {
+		return err
+	}
+	if err := st.releaseOverflow(rec, nil); err != nil {
+		return err
+	}
+	if len(st.indexes) > 0 {
+		return st.reindex(old, nil, prKey)
 	}
-	st.cols = append(st.cols, Column{ty: ty, name: name, pos: pos})
+	return nil
 }
 
+// AddColumn adds a column to the table, filling NULL into the existing records.
+func (st *Storage) AddColumn(name string, ty Type, opts ...ColumnOption) error {
+	return st.AddColumnWithDefault(name, ty, nil, opts...)
+}
+
+// Add inserts a record. Records can be added concurrently with searches and other Adds,
+// unless the table has secondary indexes.
 func (st *Storage) Add(args ...interface{}) error {
-	bytes, err := encode(st.cols, args...)
+	st.latch.RLock()
+	if st.concurrentAdd() {
+		defer st.latch.RUnlock()
+		return st.add(args, false)
+	}
+	st.latch.RUnlock()
+	st.lock()
+	defer st.unlock()
+	return st.add(args, false)
+}
+
+// Upsert inserts a record, or replaces the record having the same primary key.
+func (st *Storage) Upsert(args ...interface{}) error {
+	st.lock()
+	defer st.unlock()
+	return st.add(args, true)
+}
+
+func (st *Storage) add(args []interface{}, replace bool) error {
+	// 途中のカラムで失敗したら、それまでに書いたオーバーフローページを返す
+	var heads []uint32
+	spill := func(data []byte) (uint32, error) {
+		head, err := st.spill(data)
+		if err == nil {
+			heads = append(heads, head)
+		}
+		return head, err
+	}
+	bytes, err := encode(st.cols, spill, args...)
 	if err != nil {
+		for _, head := range heads {
+			if ferr := st.freeChain(head); ferr != nil {
+				return ferr
+			}
+		}
 		return err
 	}
-	st.addRecord(Record{size: uint32(len(bytes)), data: bytes})
-	return nil
+	return st.addRecord(st.newRecord(bytes), replace)
 }
 
-func (st *Storage) Update(prVal interface{}, targetColName string, replaceTo interface{}) UpdateInfo {
-	col, _ := st.GetPrColumn()
-	prKey := st.GetPrimaryKey(prVal)
-	curBlk := st.SearchPrKey(prKey)
-	curPage := st.ptb.pin(curBlk)
-	// レコードの書き換え
+// concurrentAdd reports whether a record can be added under the shared table latch.
+// インデックスの一意性の確認と更新、カラムのバージョンの記録はほかの操作と並行できない
+func (st *Storage) concurrentAdd() bool {
+	return st.used && len(st.indexes) == 0
+}
+
+// Update sets the column targetColName of the record whose primary key is prVal to replaceTo
+// and returns the UpdateInfo to be logged.
+func (st *Storage) Update(prVal interface{}, targetColName string, replaceTo interface{}) (UpdateInfo, error) {
+	st.lock()
+	defer st.unlock()
+	prKey, err := st.primaryKey(prVal)
+	if err != nil {
+		return UpdateInfo{}, err
+	}
 	// 対象のカラムを検索
 	targetColIndex := -1
 	for i, c := range st.cols {
@@ -131,135 +266,236 @@ func (st *Storage) Update(prVal interface{}, targetColName string, replaceTo int
 			targetColIndex = i
 		}
 	}
-	if targetColIndex == 0 {
-		panic(errors.New("cannot update primary key"))
-	}
 	if targetColIndex == -1 {
-		panic(errors.New("invalid target column name"))
+		return UpdateInfo{}, ErrColumnNotFound
+	}
+	if st.isKeyColumn(targetColIndex) {
+		return UpdateInfo{}, ErrKeyColumn
+	}
+	curBlk, curPage, err := st.latchLeaf(prKey)
+	if err != nil {
+		return UpdateInfo{}, err
 	}
 
 	targetCol := st.cols[targetColIndex]
 
 	// 該当レコードを取得
-	ptrIdx := curPage.locateLocally(prKey)
-	if ptrIdx == 0 {
-		// locate locallyにおいてleaf Nodeの倍に key <= comparedにすればここはいらなくなる?
-		// ただしページ分割なども修正する必要あり
-		panic(errors.New("key not found"))
-	}
-	cellIdx := curPage.ptrs[ptrIdx-1]
-	if curPage.cells[cellIdx].getKey() != prKey {
-		panic(errors.New("key not found"))
+	// UpdateInfoのPtrIdxは1-indexed
+	idx := curPage.findKey(st.comparator(), prKey)
+	if idx == -1 {
+		st.ptb.unlatch(curBlk, latchExclusive)
+		return UpdateInfo{}, ErrKeyNotFound
 	}
+	ptrIdx := uint32(idx + 1)
+	cellIdx := curPage.ptrs[idx]
 	// レコードを抜き出す
-	rec := curPage.cells[cellIdx].(KeyValueCell).rec
-	fromBuf := make([]byte, col.Size())
-	toBuf := make([]byte, col.Size())
-
-	if targetCol.ty.id == integerId {
-		val := uint32(replaceTo.(int))
-		binary.BigEndian.PutUint32(toBuf, val)
-	} else if targetCol.ty.id == charId {
-		toBuf = util.ToByteStringWithSize(replaceTo.(string), col.ty.size)
-	} else {
-		panic(errors.New("not implemented yet"))
-	}
-	copy(fromBuf, rec.data[targetCol.pos:targetCol.pos+targetCol.Size()])
-	copy(rec.data[targetCol.pos:targetCol.pos+targetCol.Size()], toBuf)
-
-	curPage.cells[cellIdx] = KeyValueCell{key: rec.getKey(), rec: rec}
-	st.ptb.unpin(curBlk)
+	cell := curPage.cells[cellIdx].(KeyValueCell)
+	fromBuf, err := fieldBytes(targetCol, fieldAt(st.cols, targetColIndex, st.upgrade(cell.rec)), st.load)
+	if err != nil {
+		st.ptb.unlatch(curBlk, latchExclusive)
+		return UpdateInfo{}, err
+	}
+	toBuf, err := encodeNullable(targetCol, replaceTo)
+	if err != nil {
+		st.ptb.unlatch(curBlk, latchExclusive)
+		return UpdateInfo{}, err
+	}
+	newCell, err := st.replaceColumn(cell, targetColIndex, toBuf)
+	if err != nil {
+		st.ptb.unlatch(curBlk, latchExclusive)
+		return UpdateInfo{}, err
+	}
+	old, row, err := st.indexUpdate(cell, newCell)
+	if err != nil {
+		st.ptb.unlatch(curBlk, latchExclusive)
+		return UpdateInfo{}, st.abandon(newCell.rec, st.overflowHeads(cell.rec), err)
+	}
+	// レコードを書き換えられてからインデックスを更新する
+	blk, ok, err := st.replaceCell(curBlk, curPage, cellIdx, newCell)
+	if err != nil {
+		return UpdateInfo{}, err
+	}
+	if err := st.reindex(old, row, prKey); err != nil {
+		return UpdateInfo{}, err
+	}
+	if !ok {
+		curBlk = blk
+		pg, err := st.ptb.latch(curBlk, latchShared)
+		if err != nil {
+			return UpdateInfo{}, err
+		}
+		ptrIdx = uint32(pg.findKey(st.comparator(), prKey) + 1)
+		st.ptb.unlatch(curBlk, latchShared)
+	}
+	if err := st.releaseOverflow(cell.rec, st.overflowHeads(newCell.rec)); err != nil {
+		return UpdateInfo{}, err
+	}
 	// UpdateInfoの作成
 	updateInfo := NewUpdateInfo(curBlk.BlockNum, ptrIdx, uint32(targetColIndex), fromBuf, toBuf)
-	return updateInfo
+	return updateInfo, nil
 }
 
-func (st *Storage) UpdateFromInfo(ui *UpdateInfo) {
-	curPage := st.ptb.pin(NewBlockId(ui.PageIdx, StorageFile))
-	cellIdx := curPage.ptrs[ui.PtrIdx-1]
-	rec := curPage.cells[cellIdx].(KeyValueCell).rec
-	targetCol := st.cols[ui.ColNum]
-	copy(rec.data[targetCol.pos:targetCol.pos+targetCol.Size()], ui.To)
-	curPage.cells[cellIdx] = KeyValueCell{key: rec.getKey(), rec: rec}
+// latchLeaf returns the leaf where prKey is stored, latched exclusively.
+// 排他のテーブルのラッチを持っている間は、ラッチを取り直す間に木が変わることはない
+func (st *Storage) latchLeaf(prKey []byte) (BlockId, *Page, error) {
+	blk, _, err := st.tree().search(prKey)
+	if err != nil {
+		return BlockId{}, nil, err
+	}
+	st.ptb.unlatch(blk, latchShared)
+	pg, err := st.ptb.latch(blk, latchExclusive)
+	return blk, pg, err
 }
 
-func (st *Storage) selectInt(col Column) (res []interface{}, err error) {
-	if col.ty.id != integerId {
-		return nil, errors.New("you must specify int type column")
+// Get returns the record whose primary key is prVal, decoded with the columns of the table.
+func (st *Storage) Get(prVal interface{}) ([]interface{}, error) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	prKey, err := st.primaryKey(prVal)
+	if err != nil {
+		return nil, err
 	}
-	pageQueue := algorithm.NewQueue(64)
-	pageQueue.Push(int(st.rootBlk.BlockNum))
-	for !pageQueue.IsEmpty() {
-		curPageIndex := uint32(pageQueue.Pop())
-		curPage := st.ptb.read(NewBlockId(curPageIndex, StorageFile))
-		if curPage.header.isLeaf {
-			for _, ptr := range curPage.ptrs {
-				rec := curPage.cells[ptr].(KeyValueCell).rec
-				bytes := rec.data[col.pos : col.pos+col.Size()]
-				res = append(res, int32(binary.BigEndian.Uint32(bytes)))
-			}
-		} else {
-			for i := 0; i < int(curPage.header.numOfPtr-1); i++ {
-				pageQueue.Push(int(curPage.cells[curPage.ptrs[i]].(KeyCell).pageIndex))
-			}
-			pageQueue.Push(int(curPage.cells[curPage.header.rightmostPtr].(KeyCell).pageIndex))
-		}
+	return st.getByKey(prKey)
+}
+
+func (st *Storage) getByKey(prKey []byte) ([]interface{}, error) {
+	rec, found, err := st.recordByKey(prKey)
+	if err != nil {
+		return nil, err
 	}
-	return
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return st.decodeRecord(rec)
 }
 
-func (st *Storage) selectChar(col Column) (res []interface{}, err error) {
+func (st *Storage) recordByKey(prKey []byte) (Record, bool, error) {
+	if empty, err := st.isEmpty(); err != nil || empty {
+		return Record{}, false, err
+	}
+	// 検索から読み出しまでリーフのラッチを持っておく
+	blk, curPage, err := st.tree().search(prKey)
+	if err != nil {
+		return Record{}, false, err
+	}
+	defer st.ptb.unlatch(blk, latchShared)
+	idx := curPage.findKey(st.comparator(), prKey)
+	if idx == -1 {
+		return Record{}, false, nil
+	}
+	return curPage.cells[curPage.ptrs[idx]].(KeyValueCell).rec, true, nil
+}
 
-	if col.ty.id != charId {
-		return nil, errors.New("you must specify char type column")
+func (st *Storage) UpdateFromInfo(ui *UpdateInfo) error {
+	st.lock()
+	defer st.unlock()
+	blk := NewBlockId(ui.PageIdx, StorageFile)
+	curPage, err := st.ptb.latch(blk, latchExclusive)
+	if err != nil {
+		return err
 	}
-	pageQueue := algorithm.NewQueue(64)
-	pageQueue.Push(int(st.rootBlk.BlockNum))
-	for !pageQueue.IsEmpty() {
-		curPageIndex := uint32(pageQueue.Pop())
-		curPage := st.ptb.read(NewBlockId(curPageIndex, StorageFile))
-		if curPage.header.isLeaf {
-			for _, ptr := range curPage.ptrs {
-				rec := curPage.cells[ptr].(KeyValueCell).rec
-				bytes := rec.data[col.pos:]
-				s := util.ReadStringWithSize(col.ty.size, bytes)
-				res = append(res, s)
-			}
-		} else {
-			for i := 0; i < int(curPage.header.numOfPtr-1); i++ {
-				pageQueue.Push(int(curPage.cells[curPage.ptrs[i]].(KeyCell).pageIndex))
-			}
-			pageQueue.Push(int(curPage.cells[curPage.header.rightmostPtr].(KeyCell).pageIndex))
+	if !curPage.header.isLeaf || ui.PtrIdx == 0 || ui.PtrIdx > curPage.header.numOfPtr || int(ui.ColNum) >= len(st.cols) {
+		st.ptb.unlatch(blk, latchExclusive)
+		return ErrKeyNotFound
+	}
+	cellIdx := curPage.ptrs[ui.PtrIdx-1]
+	cell := curPage.cells[cellIdx].(KeyValueCell)
+	newCell, err := st.replaceColumn(cell, int(ui.ColNum), ui.To)
+	if err != nil {
+		st.ptb.unlatch(blk, latchExclusive)
+		return err
+	}
+	old, row, err := st.indexUpdate(cell, newCell)
+	if err != nil {
+		st.ptb.unlatch(blk, latchExclusive)
+		return st.abandon(newCell.rec, st.overflowHeads(cell.rec), err)
+	}
+	if _, _, err := st.replaceCell(blk, curPage, cellIdx, newCell); err != nil {
+		return err
+	}
+	if err := st.reindex(old, row, cell.key); err != nil {
+		return err
+	}
+	return st.releaseOverflow(cell.rec, st.overflowHeads(newCell.rec))
+}
+
+// replaceCell overwrites the cell at cellIdx of the leaf blk with newCell.
+// pg is the page of blk latched exclusively, and it is unlatched by replaceCell.
+// If the leaf no longer fits in a page, newCell is put through the tree so that the leaf is split,
+// and the block now holding it is returned with false.
+func (st *Storage) replaceCell(blk BlockId, pg *Page, cellIdx uint32, newCell KeyValueCell) (BlockId, bool, error) {
+	oldCell := pg.cells[cellIdx].(KeyValueCell)
+	if pg.usedBytes()-oldCell.getSize()+newCell.getSize() <= pg.size {
+		pg.replaceCell(cellIdx, newCell)
+		st.ptb.unlatch(blk, latchExclusive)
+		return blk, true, nil
+	}
+	st.ptb.unlatch(blk, latchExclusive)
+	bt := st.tree()
+	if err := bt.insert(newCell, true); err != nil {
+		return BlockId{}, false, st.abandon(newCell.rec, st.overflowHeads(oldCell.rec), err)
+	}
+	blk, _, err := bt.search(newCell.key)
+	if err != nil {
+		return BlockId{}, false, err
+	}
+	st.ptb.unlatch(blk, latchShared)
+	return blk, false, nil
+}
+
+// replaceColumn returns cell whose column idx is replaced by buf encoded with encodeNullable.
+// 可変長のカラムではレコードの長さが変わるので、レコードを作り直す
+func (st *Storage) replaceColumn(cell KeyValueCell, idx int, buf []byte) (KeyValueCell, error) {
+	col := st.cols[idx]
+	f, err := toField(col, buf, st.spill)
+	if err != nil {
+		return cell, err
+	}
+	data := setColumn(st.cols, st.upgrade(cell.rec), idx, f)
+	newCell := cell
+	newCell.rec = st.newRecord(data)
+	if newCell.getSize() > maxCellSize(st.fm.PageSize()) {
+		return cell, st.abandon(newCell.rec, st.overflowHeads(cell.rec), ErrRecordTooLarge)
+	}
+	return newCell, nil
+}
+
+func (st *Storage) spill(data []byte) (uint32, error) {
+	blks, err := writeOverflow(st.cat.alloc, data)
+	if err != nil {
+		if ferr := st.freeBlocks(blks); ferr != nil {
+			return 0, ferr
 		}
+		return 0, err
 	}
-	return
+	return blks[0].BlockNum, nil
+}
+
+func (st *Storage) load(blkNum uint32, size uint32) ([]byte, error) {
+	return readOverflow(st.fm, blkNum, size)
 }
 
+func (st *Storage) decodeRecord(rec Record) ([]interface{}, error) {
+	return decodeRow(st.cols, st.upgrade(rec), st.load)
+}
+
+// Select returns the values of the columns in names, one slice per column.
 func (st *Storage) Select(verbose bool, names ...string) (res [][]interface{}, err error) {
-	for _, name := range names {
-		for _, col := range st.cols {
-			if name != col.name {
-				continue
-			}
-			if col.ty.id == integerId {
-				values, err := st.selectInt(col)
-				if err != nil {
-					return nil, err
-				}
-				res = append(res, values)
-				break
-			} else if col.ty.id == charId {
-				values, err := st.selectChar(col)
-				if err != nil {
-					return nil, err
-				}
-				res = append(res, values)
-				break
-			} else {
-				return nil, errors.New("the type of a column is not implemented")
-			}
+	rows, err := st.Rows(nil, names...)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		res = make([][]interface{}, len(names))
+	}
+	for rows.Next() {
+		for j, val := range rows.Values() {
+			res[j] = append(res[j], val)
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	if verbose {
 		for _, name := range names {
 			fmt.Printf("| %s\t", name)
@@ -283,13 +519,20 @@ func (st *Storage) Select(verbose bool, names ...string) (res [][]interface{}, e
 	return res, nil
 }
 
-func (st *Storage) Print() {
+func (st *Storage) Print() error {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
 	fmt.Println("--- start table print ---")
 	pageQueue := algorithm.NewQueue(64)
 	pageQueue.Push(int(st.rootBlk.BlockNum))
+	ring := st.ptb.newRing()
 	for !pageQueue.IsEmpty() {
 		curPageIndex := uint32(pageQueue.Pop())
-		curPage := st.ptb.read(NewBlockId(curPageIndex, StorageFile))
+		curBlk := NewBlockId(curPageIndex, StorageFile)
+		curPage, err := st.ptb.latchWith(curBlk, latchShared, ring)
+		if err != nil {
+			return err
+		}
 		fmt.Printf("Page Index is %d\n", curPageIndex)
 		curPage.info()
 		if !curPage.header.isLeaf {
@@ -298,59 +541,179 @@ func (st *Storage) Print() {
 			}
 			pageQueue.Push(int(curPage.cells[curPage.header.rightmostPtr].(KeyCell).pageIndex))
 		}
-
+		st.ptb.unlatch(curBlk, latchShared)
 	}
-
+	return nil
 }
 
 func (st *Storage) ColumnLength() int {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
 	return len(st.cols)
 }
 
 func (st *Storage) GetPrColumn() (Column, error) {
-	if st.ColumnLength() == 0 {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	if len(st.cols) == 0 {
 		return Column{}, errors.New("out of range")
 	}
-	// use index 0 as primary column for now
-	return (st.cols)[0], nil
-}
-
-func (st *Storage) GetPrimaryKey(prVal interface{}) int32 {
-	col, _ := st.GetPrColumn()
-	buf := make([]byte, col.ty.size)
-	if col.ty.id == integerId {
-		val := uint32(prVal.(int))
-		binary.BigEndian.PutUint32(buf, val)
-	} else if col.ty.id == charId {
-		rd := strings.NewReader(prVal.(string))
-		rd.Read(buf)
-	} else {
-		panic(errors.New("the type of a column is not implemented"))
-	}
-	return int32(binary.BigEndian.Uint32(buf[:IntSize]))
-}
-
-func (st *Storage) SearchPrKey(prKey int32) BlockId {
-	rootPage := st.ptb.pin(st.rootBlk)
-	if rootPage.header.numOfPtr == 0 {
-		panic(errors.New("unexpected"))
-	}
-	curBlk := st.rootBlk
-	curPage := rootPage
-	for !curPage.header.isLeaf {
-		idx := curPage.locateLocally(prKey)
-		var childBlkId uint32
-		if idx == curPage.header.numOfPtr {
-			childBlkId = curPage.cells[curPage.header.rightmostPtr].(KeyCell).pageIndex
-		} else {
-			childBlkId = curPage.cells[curPage.ptrs[idx]].(KeyCell).pageIndex
+	return st.keyCols()[0], nil
+}
+
+// SetPrimaryKey makes the columns a (composite) primary key.
+// Without it the first column is used as the primary key.
+func (st *Storage) SetPrimaryKey(names ...string) error {
+	st.lock()
+	defer st.unlock()
+	if empty, err := st.isEmpty(); err != nil {
+		return err
+	} else if !empty {
+		return errors.New("cannot change primary key of non-empty table")
+	}
+	keys := make([]uint32, len(names))
+	for i, name := range names {
+		idx := st.columnIndex(name)
+		if idx == -1 {
+			return errors.New("invalid column name")
+		}
+		if st.cols[idx].ty.isLarge() {
+			return errors.New("TEXT or BLOB column cannot be a primary key")
 		}
-		childBlk := NewBlockId(childBlkId, StorageFile)
-		childPage := st.ptb.pin(childBlk)
-		st.ptb.unpin(curBlk)
-		curBlk = childBlk
-		curPage = childPage
-	}
-	st.ptb.unpin(curBlk)
-	return curBlk
+		keys[i] = uint32(idx)
+	}
+	st.keys = keys
+	return nil
+}
+
+// SetFillFactor sets how full pages get before they are split, from 0.1 to 1.
+// Leaving free space lets records grow by updates without splitting pages.
+func (st *Storage) SetFillFactor(fillFactor float64) error {
+	if fillFactor < minFillFactor || fillFactor > 1 {
+		return ErrInvalidFillFactor
+	}
+	st.lock()
+	defer st.unlock()
+	st.fillPercent = uint32(fillFactor * 100)
+	return nil
+}
+
+// pageLimit returns the number of bytes a page is filled up to
+func (st *Storage) pageLimit() uint32 {
+	return pageLimit(st.fm.PageSize(), st.fillFactor())
+}
+
+func (st *Storage) fillFactor() float64 {
+	if st.fillPercent == 0 {
+		return 1
+	}
+	return float64(st.fillPercent) / 100
+}
+
+func pageLimit(pageSize uint32, fillFactor float64) uint32 {
+	return uint32(float64(pageSize) * fillFactor)
+}
+
+// Compact removes the free space left by deleted and moved records from the pages of the table and its indexes.
+func (st *Storage) Compact() error {
+	st.lock()
+	defer st.unlock()
+	if err := st.tree().compact(); err != nil {
+		return err
+	}
+	for i := range st.indexes {
+		if err := st.indexTree(i).compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *Storage) columnIndex(name string) int {
+	for i, c := range st.cols {
+		if c.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (st *Storage) isKeyColumn(idx int) bool {
+	for _, k := range st.keyIndices() {
+		if int(k) == idx {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *Storage) keyIndices() []uint32 {
+	if len(st.keys) == 0 {
+		return []uint32{0}
+	}
+	return st.keys
+}
+
+func (st *Storage) keyCols() []Column {
+	indices := st.keyIndices()
+	cols := make([]Column, len(indices))
+	for i, idx := range indices {
+		cols[i] = st.cols[idx]
+	}
+	return cols
+}
+
+func (st *Storage) comparator() Comparator {
+	return NewKeyComparator(st.keyCols())
+}
+
+func (st *Storage) keyOf(rec Record) ([]byte, error) {
+	key := []byte{}
+	for _, idx := range st.keyIndices() {
+		col := st.cols[idx]
+		f := fieldAt(st.cols, int(idx), rec.data)
+		switch {
+		case f.null:
+			return nil, ErrNotNull
+		case col.ty.isLarge():
+			return nil, ErrInvalidKey
+		case col.ty.isVariable():
+			key = append(key, withLength(f.body)...)
+		default:
+			key = append(key, f.body...)
+		}
+	}
+	return key, nil
+}
+
+// GetPrimaryKey encodes prVal into the key of the B+tree.
+// For a composite primary key prVal must be []interface{} holding a value for each key column.
+func (st *Storage) GetPrimaryKey(prVal interface{}) ([]byte, error) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	return st.primaryKey(prVal)
+}
+
+func (st *Storage) primaryKey(prVal interface{}) ([]byte, error) {
+	cols := st.keyCols()
+	if len(cols) == 1 {
+		return encodeKey(cols, []interface{}{prVal})
+	}
+	vals, ok := prVal.([]interface{})
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	return encodeKey(cols, vals)
+}
+
+// SearchPrKey returns the leaf where prKey is stored or would be inserted.
+func (st *Storage) SearchPrKey(prKey []byte) (BlockId, error) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
+	blk, _, err := st.tree().search(prKey)
+	if err != nil {
+		return BlockId{}, err
+	}
+	st.ptb.unlatch(blk, latchShared)
+	return blk, nil
 }
@@ -1,9 +1,15 @@
 package storage_test
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/tychyDB/assert"
 	"github.com/tychyDB/storage"
 	"github.com/tychyDB/util"
 )
@@ -102,11 +108,11 @@ func TestStorageChar(t *testing.T) {
 	if res[0][1].(string) != "China" {
 		t.Errorf("expected: China, actual: %s\n", res[0][1].(string))
 	}
-	if res[0][2].(string) != "Russia" {
-		t.Errorf("expected: Russia, actual: %s\n", res[0][2].(string))
+	if res[0][2].(string) != "Japan" {
+		t.Errorf("expected: Japan, actual: %s\n", res[0][2].(string))
 	}
-	if res[0][3].(string) != "Brazil" {
-		t.Errorf("expected: Brazil, actual: %s\n", res[0][3].(string))
+	if res[0][3].(string) != "Nigeria" {
+		t.Errorf("expected: Nigeria, actual: %s\n", res[0][3].(string))
 	}
 
 	countryTable.Flush()
@@ -114,14 +120,14 @@ func TestStorageChar(t *testing.T) {
 	if err != nil {
 		t.Error("failure select")
 	}
-	if res[0][0].(string) != "Asia" {
-		t.Errorf("expected: Asia, actual: %s\n", res[0][0].(string))
+	if res[0][0].(string) != "South America" {
+		t.Errorf("expected: South America, actual: %s\n", res[0][0].(string))
 	}
 	if res[1][1].(string) != "China" {
 		t.Errorf("expected: China, actual: %s\n", res[1][1].(string))
 	}
-	if res[1][2].(string) != "Russia" {
-		t.Errorf("expected: Russia, actual: %s\n", res[1][2].(string))
+	if res[1][2].(string) != "Japan" {
+		t.Errorf("expected: Japan, actual: %s\n", res[1][2].(string))
 	}
 	if res[1][5].(string) != "United States" {
 		t.Errorf("expected: United States, actual: %s\n", res[1][3].(string))
@@ -294,11 +300,13 @@ func TestUpdateFromInfo(t *testing.T) {
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb) // hogeがプライマリー
 
-	ui := st.Update(10, "fuga", 44)
+	ui := mustUpdate(t, st, 10, "fuga", 44)
 	gen := util.NewGenStruct(0, uint32(len(ui.To)))
 	gen.PutUInt32(555)
 	ui.To = gen.DumpBytes()
-	st.UpdateFromInfo(&ui)
+	if err := st.UpdateFromInfo(&ui); err != nil {
+		t.Fatal(err)
+	}
 
 	res, err := st.Select(false, "hoge", "fuga", "piyo", "fuga")
 	if err != nil {
@@ -309,6 +317,32 @@ func TestUpdateFromInfo(t *testing.T) {
 	}
 }
 
+func TestUpdateErrors(t *testing.T) {
+	storage.CreateStorage()
+
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+	st := storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+
+	if _, err := st.Update(3, "fuga", 1); err != storage.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, actual: %v", err)
+	}
+	if _, err := st.Update(2, "nothing", 1); err != storage.ErrColumnNotFound {
+		t.Errorf("expected ErrColumnNotFound, actual: %v", err)
+	}
+	if _, err := st.Update(2, "hoge", 1); err != storage.ErrKeyColumn {
+		t.Errorf("expected ErrKeyColumn, actual: %v", err)
+	}
+	if _, err := st.Update(2, "fuga", "str"); err == nil {
+		t.Error("expected type error")
+	}
+	ui := mustUpdate(t, st, 2, "fuga", 33)
+	ui.PtrIdx = 1000
+	if err := st.UpdateFromInfo(&ui); err != storage.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, actual: %v", err)
+	}
+}
+
 func TestUpdateFromInfoMixed(t *testing.T) {
 	storage.CreateStorageWithChar()
 
@@ -318,17 +352,21 @@ func TestUpdateFromInfoMixed(t *testing.T) {
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb) // hogeがプライマリー
 
-	ui := st.Update(10, "fuga", 44)
+	ui := mustUpdate(t, st, 10, "fuga", 44)
 	gen := util.NewGenStruct(0, uint32(len(ui.To)))
 	gen.PutUInt32(555)
 	ui.To = gen.DumpBytes()
-	st.UpdateFromInfo(&ui)
+	if err := st.UpdateFromInfo(&ui); err != nil {
+		t.Fatal(err)
+	}
 
-	ui = st.Update(500, "hogefuga", "before")
+	ui = mustUpdate(t, st, 500, "hogefuga", "before")
 	gen = util.NewGenStruct(0, 14)
 	gen.PutStringWithSize("after", 10)
 	ui.To = gen.DumpBytes()
-	st.UpdateFromInfo(&ui)
+	if err := st.UpdateFromInfo(&ui); err != nil {
+		t.Fatal(err)
+	}
 
 	res, err := st.Select(false, "hoge", "fuga", "piyo", "hogefuga")
 	if err != nil {
@@ -339,3 +377,1113 @@ func TestUpdateFromInfoMixed(t *testing.T) {
 		t.Errorf("expected: after, actual: %v", res[3][5].(string))
 	}
 }
+
+func TestDelete(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("hoge", storage.IntergerType)
+	st.AddColumn("fuga", storage.IntergerType)
+
+	n := 3000
+	for _, i := range rand.Perm(n) {
+		st.Add(i, i*10)
+	}
+	// 偶数のキーを削除する
+	for _, i := range rand.Perm(n) {
+		if i%2 == 0 {
+			if err := st.Delete(i); err != nil {
+				t.Fatalf("failed to delete %d: %v", i, err)
+			}
+		}
+	}
+	if err := st.Delete(0); err != storage.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, actual: %v", err)
+	}
+
+	res, err := st.Select(false, "hoge", "fuga")
+	if err != nil {
+		t.Error("failure select")
+	}
+	if len(res[0]) != n/2 {
+		t.Fatalf("expected: %d rows, actual: %d", n/2, len(res[0]))
+	}
+	for i, v := range res[0] {
+		assert.EqualInt32(t, v.(int32), int32(2*i+1))
+		assert.EqualInt32(t, res[1][i].(int32), int32(2*i+1)*10)
+	}
+
+	st.Flush()
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	for i := 1; i < n; i += 2 {
+		if err := st.Delete(i); err != nil {
+			t.Fatalf("failed to delete %d: %v", i, err)
+		}
+	}
+	res, _ = st.Select(false, "hoge")
+	if len(res[0]) != 0 {
+		t.Errorf("expected: empty, actual: %v", res[0])
+	}
+
+	st.Add(7, 70)
+	st.Add(3, 30)
+	res, _ = st.Select(false, "hoge", "fuga")
+	assert.EqualInt32(t, res[0][0].(int32), 3)
+	assert.EqualInt32(t, res[1][1].(int32), 70)
+}
+
+func TestCharPrimaryKey(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("code", storage.CharType(10))
+	st.AddColumn("price", storage.IntergerType)
+	// 先頭4バイトが同じキー
+	st.Add("abcd-2", 20)
+	st.Add("abcd-10", 100)
+	st.Add("abcd-1", 10)
+	st.Add("abc", 0)
+
+	res, err := st.Select(false, "code", "price")
+	if err != nil {
+		t.Error("failure select")
+	}
+	expected := []string{"abc", "abcd-1", "abcd-10", "abcd-2"}
+	for i, code := range expected {
+		assert.Equal(t, res[0][i], code)
+	}
+	st.Update("abcd-10", "price", 1000)
+	res, _ = st.Select(false, "price")
+	assert.EqualInt32(t, res[0][2].(int32), 1000)
+	assert.EqualInt32(t, res[0][3].(int32), 20)
+}
+
+func TestCompositePrimaryKey(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("country", storage.CharType(8))
+	st.AddColumn("year", storage.IntergerType)
+	st.AddColumn("population", storage.IntergerType)
+	if err := st.SetPrimaryKey("country", "year"); err != nil {
+		t.Fatal(err)
+	}
+	st.Add("japan", 2020, 126)
+	st.Add("china", 2020, 1411)
+	st.Add("japan", 2000, 127)
+	st.Add("china", 2000, 1290)
+	st.Add("japan", 1990, 123)
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st.Update([]interface{}{"japan", 2000}, "population", 126)
+	if err := st.Delete([]interface{}{"china", 2020}); err != nil {
+		t.Error(err)
+	}
+	if err := st.Delete("china"); err != storage.ErrInvalidKey {
+		t.Errorf("expected ErrInvalidKey, actual: %v", err)
+	}
+
+	res, err := st.Select(false, "country", "year", "population")
+	if err != nil {
+		t.Error("failure select")
+	}
+	if len(res[0]) != 4 {
+		t.Fatalf("expected: 4 rows, actual: %d", len(res[0]))
+	}
+	assert.Equal(t, res[0][0], "china")
+	assert.EqualInt32(t, res[1][0].(int32), 2000)
+	assert.Equal(t, res[0][1], "japan")
+	assert.EqualInt32(t, res[1][1].(int32), 1990)
+	assert.EqualInt32(t, res[1][2].(int32), 2000)
+	assert.EqualInt32(t, res[2][2].(int32), 126)
+	assert.EqualInt32(t, res[1][3].(int32), 2020)
+}
+
+func TestDuplicateKey(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("hoge", storage.IntergerType)
+	st.AddColumn("fuga", storage.IntergerType)
+	for i := 0; i < 20; i++ {
+		if err := st.Add(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if err := st.Add(i, -1); err != storage.ErrDuplicateKey {
+			t.Errorf("expected ErrDuplicateKey, actual: %v", err)
+		}
+	}
+	if err := st.Upsert(5, 500); err != nil {
+		t.Error(err)
+	}
+	if err := st.Upsert(100, 1000); err != nil {
+		t.Error(err)
+	}
+
+	res, _ := st.Select(false, "hoge", "fuga")
+	if len(res[0]) != 21 {
+		t.Fatalf("expected: 21 rows, actual: %d", len(res[0]))
+	}
+	assert.EqualInt32(t, res[1][5].(int32), 500)
+	assert.EqualInt32(t, res[1][6].(int32), 6)
+	assert.EqualInt32(t, res[0][20].(int32), 100)
+	assert.EqualInt32(t, res[1][20].(int32), 1000)
+}
+
+func mustUpdate(t *testing.T, st *storage.Storage, prVal interface{}, colName string, v interface{}) storage.UpdateInfo {
+	ui, err := st.Update(prVal, colName, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ui
+}
+
+func scanKeys(t *testing.T, st *storage.Storage, from, to interface{}, reverse bool) []int32 {
+	cur, err := st.Scan(from, to, reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []int32{}
+	for cur.Next() {
+		keys = append(keys, cur.Values()[0].(int32))
+	}
+	return keys
+}
+
+func equalKeys(t *testing.T, actual []int32, expected ...int32) {
+	if len(actual) != len(expected) {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+		return
+	}
+	for i := range expected {
+		assert.EqualInt32(t, actual[i], expected[i])
+	}
+}
+
+func TestScan(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("ts", storage.IntergerType)
+	st.AddColumn("value", storage.IntergerType)
+
+	equalKeys(t, scanKeys(t, st, nil, nil, false))
+	for _, i := range rand.Perm(30) {
+		st.Add(i*10, i)
+	}
+
+	equalKeys(t, scanKeys(t, st, 35, 80, false), 40, 50, 60, 70, 80)
+	equalKeys(t, scanKeys(t, st, 35, 80, true), 80, 70, 60, 50, 40)
+	equalKeys(t, scanKeys(t, st, nil, 20, false), 0, 10, 20)
+	equalKeys(t, scanKeys(t, st, 265, nil, false), 270, 280, 290)
+	equalKeys(t, scanKeys(t, st, 265, nil, true), 290, 280, 270)
+	equalKeys(t, scanKeys(t, st, nil, 5, true), 0)
+	equalKeys(t, scanKeys(t, st, 300, nil, false))
+	equalKeys(t, scanKeys(t, st, 81, 89, false))
+	if keys := scanKeys(t, st, nil, nil, true); len(keys) != 30 || keys[0] != 290 || keys[29] != 0 {
+		t.Errorf("unexpected reverse full scan: %v", keys)
+	}
+
+	for i := 0; i < 30; i++ {
+		if i%3 != 0 {
+			st.Delete(i * 10)
+		}
+	}
+	st.Flush()
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	equalKeys(t, scanKeys(t, st, 10, 130, false), 30, 60, 90, 120)
+	equalKeys(t, scanKeys(t, st, 10, 130, true), 120, 90, 60, 30)
+	if keys := scanKeys(t, st, nil, nil, false); len(keys) != 10 {
+		t.Errorf("expected: 10 keys, actual: %v", keys)
+	}
+}
+
+func TestGet(t *testing.T) {
+	storage.CreateStorageWithChar()
+
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorageFromFile(fm, ptb)
+
+	row, err := st.Get(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualInt32(t, row[0].(int32), 500)
+	assert.EqualInt32(t, row[1].(int32), 5)
+	assert.Equal(t, row[2], "pokemon")
+	assert.EqualInt32(t, row[3].(int32), 90)
+
+	st.Update(500, "hogefuga", "pikachu")
+	row, _ = st.Get(500)
+	assert.Equal(t, row[2], "pikachu")
+
+	if _, err := st.Get(501); err != storage.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, actual: %v", err)
+	}
+	if _, err := st.Get("500"); err != storage.ErrTypeMismatch {
+		t.Errorf("expected ErrTypeMismatch, actual: %v", err)
+	}
+}
+
+func TestRows(t *testing.T) {
+	storage.CreateStorageWithChar()
+
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorageFromFile(fm, ptb)
+
+	pred := storage.And(
+		storage.Ge("fuga", 5),
+		storage.Or(storage.Eq("hogefuga", "pika"), storage.Lt("piyo", 100)),
+		storage.Not(storage.Eq("hoge", 10000)),
+	)
+	rows, err := st.Rows(pred, "hogefuga", "hoge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	var key int
+	names := []string{}
+	keys := []int{}
+	for rows.Next() {
+		if err := rows.Scan(&name, &key); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+		keys = append(keys, key)
+	}
+	// fuga >= 5 を満たすのは -345, -100, 10, 500, 80000
+	// そのうちpiyo < 100 を満たさない -100 を除く
+	expected := []int{-345, 10, 500, 80000}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, keys)
+	}
+	for i := range expected {
+		assert.EqualInt32(t, int32(keys[i]), int32(expected[i]))
+	}
+	assert.Equal(t, names[0], "767")
+	assert.Equal(t, names[3], "bigbigbigA")
+
+	if _, err := st.Rows(storage.Eq("unknown", 1), "hoge"); err != storage.ErrColumnNotFound {
+		t.Errorf("expected ErrColumnNotFound, actual: %v", err)
+	}
+	if _, err := st.Rows(storage.Eq("hoge", "1"), "hoge"); err != storage.ErrTypeMismatch {
+		t.Errorf("expected ErrTypeMismatch, actual: %v", err)
+	}
+	rows, _ = st.Rows(nil, "hoge")
+	rows.Next()
+	if err := rows.Scan(&name); err == nil {
+		t.Error("expected an error when scanning INTEGER into string")
+	}
+}
+
+func TestVarchar(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("name", storage.VarcharType(32))
+	st.AddColumn("description", storage.VarcharType(1000))
+	st.AddColumn("stock", storage.IntergerType)
+
+	long := strings.Repeat("a fine product. ", 60)
+	st.Add("pen", "", 10)
+	st.Add("notebook", long, 20)
+	st.Add("eraser", "white", 30)
+	st.Add("ink", "black", 40)
+	if err := st.Add(strings.Repeat("x", 33), "", 0); err != storage.ErrStringTooLong {
+		t.Errorf("expected ErrStringTooLong, actual: %v", err)
+	}
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	res, err := st.Select(false, "name", "description")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"eraser", "ink", "notebook", "pen"}
+	for i, name := range expected {
+		assert.Equal(t, res[0][i], name)
+	}
+	assert.Equal(t, res[1][2], long)
+	assert.Equal(t, res[1][3], "")
+
+	st.Update("pen", "description", "blue")
+	st.Update("ink", "stock", 45)
+	row, err := st.Get("pen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, row[1], "blue")
+	assert.EqualInt32(t, row[2].(int32), 10)
+	row, _ = st.Get("ink")
+	assert.Equal(t, row[1], "black")
+	assert.EqualInt32(t, row[2].(int32), 45)
+}
+
+func TestText(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("body", storage.TextType)
+	st.AddColumn("raw", storage.BlobType)
+
+	// ページより大きな値はオーバーフローページに置かれる
+	large := strings.Repeat("0123456789", 1000)
+	blob := make([]byte, 5000)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	st.Add(1, "short", []byte{1, 2, 3})
+	st.Add(2, large, blob)
+	st.Add(3, "", []byte{})
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	row, err := st.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, row[1], large)
+	if !bytes.Equal(row[2].([]byte), blob) {
+		t.Error("blob mismatch")
+	}
+
+	ui := mustUpdate(t, st, 1, "body", large+"!")
+	row, _ = st.Get(1)
+	assert.Equal(t, row[1], large+"!")
+	if !bytes.Equal(row[2].([]byte), []byte{1, 2, 3}) {
+		t.Error("blob mismatch")
+	}
+
+	ui.To = ui.From
+	if err := st.UpdateFromInfo(&ui); err != nil {
+		t.Fatal(err)
+	}
+	row, _ = st.Get(1)
+	assert.Equal(t, row[1], "short")
+}
+
+func TestDoubleKey(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	st := storage.NewStorage(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st.AddColumn("rate", storage.DoubleType)
+	st.AddColumn("name", storage.VarcharType(16))
+	for i, rate := range []float64{1.5, math.Inf(1), -2, math.Inf(-1), 0} {
+		if err := st.Add(rate, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// NaNはどの値とも等しくなってしまうので受け付けない
+	if err := st.Add(math.NaN(), "nan"); err != storage.ErrNaN {
+		t.Errorf("expected ErrNaN, actual: %v", err)
+	}
+	if _, err := st.Update(1.5, "name", "x"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := st.Select(false, "rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []float64{math.Inf(-1), -2, 0, 1.5, math.Inf(1)}
+	if len(res[0]) != len(expected) {
+		t.Fatalf("expected %d rows, actual: %v", len(expected), res[0])
+	}
+	for i, rate := range expected {
+		if res[0][i].(float64) != rate {
+			t.Errorf("expected: %v, actual: %v", rate, res[0][i])
+		}
+	}
+}
+
+func TestTimestampRange(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	st := storage.NewStorage(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("at", storage.TimestampType)
+	earliest, latest := time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)
+	if err := st.Add(1, earliest); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Add(2, latest); err != nil {
+		t.Fatal(err)
+	}
+	// UnixNanoに収まらない時刻は別の時刻として読めてしまうので受け付けない
+	for i, at := range []time.Time{earliest.Add(-1), latest.Add(1), {}, time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		if err := st.Add(3+i, at); err != storage.ErrOutOfRange {
+			t.Errorf("%v: expected ErrOutOfRange, actual: %v", at, err)
+		}
+	}
+	for id, expected := range map[int]time.Time{1: earliest, 2: latest} {
+		row, err := st.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !row[1].(time.Time).Equal(expected) {
+			t.Errorf("expected: %v, actual: %v", expected, row[1])
+		}
+	}
+}
+
+func TestScalarTypes(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("id", storage.BigIntType)
+	st.AddColumn("paid", storage.BooleanType)
+	st.AddColumn("price", storage.DecimalType(2))
+	st.AddColumn("rate", storage.DoubleType)
+	st.AddColumn("at", storage.TimestampType)
+
+	jst := time.FixedZone("JST", 9*60*60)
+	at := time.Date(2021, 5, 1, 9, 30, 0, 0, jst)
+	st.Add(int64(1)<<40, true, "19.99", 0.5, at)
+	st.Add(-3, false, 5, -1.25, at.Add(time.Hour))
+	st.Add(7, true, storage.NewDecimal(-1050, 3), 3.0, at.UTC())
+	if err := st.Add(8, true, "0.001", 0.0, at); err != storage.ErrOutOfRange {
+		t.Errorf("expected ErrOutOfRange, actual: %v", err)
+	}
+	if err := st.Add(8, 1, "0.01", 0.0, at); err != storage.ErrTypeMismatch {
+		t.Errorf("expected ErrTypeMismatch, actual: %v", err)
+	}
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	res, err := st.Select(false, "id", "price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0][0].(int64) != -3 || res[0][1].(int64) != 7 || res[0][2].(int64) != 1<<40 {
+		t.Errorf("unexpected order: %v", res[0])
+	}
+	assert.Equal(t, res[1][0].(storage.Decimal).String(), "5.00")
+	assert.Equal(t, res[1][1].(storage.Decimal).String(), "-1.05")
+	assert.Equal(t, res[1][2].(storage.Decimal).String(), "19.99")
+
+	row, err := st.Get(int64(1) << 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, row[1], true)
+	if row[3].(float64) != 0.5 {
+		t.Errorf("expected: 0.5, actual: %v", row[3])
+	}
+	ts := row[4].(time.Time)
+	if !ts.Equal(at) {
+		t.Errorf("expected: %v, actual: %v", at, ts)
+	}
+	if _, offset := ts.Zone(); offset != 9*60*60 {
+		t.Errorf("time zone offset is lost: %v", ts)
+	}
+
+	rows, err := st.Rows(storage.And(storage.Eq("paid", true), storage.Ge("price", "10")), "id", "at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	var ts2 time.Time
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(&id, &ts2); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 1 || id != 1<<40 || !ts2.Equal(at) {
+		t.Errorf("unexpected rows: count %d, id %d, at %v", count, id, ts2)
+	}
+}
+
+func TestTimestampKey(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("at", storage.TimestampType)
+	st.AddColumn("event", storage.VarcharType(16))
+
+	// タイムゾーンが異なっても時刻順に並ぶ
+	base := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	st.Add(base.In(time.FixedZone("", -5*60*60)), "second")
+	st.Add(base.Add(-time.Minute).In(time.FixedZone("", 9*60*60)), "first")
+	st.Add(base.Add(time.Minute), "third")
+	res, err := st.Select(false, "event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"first", "second", "third"} {
+		assert.Equal(t, res[0][i], expected)
+	}
+	row, err := st.Get(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, row[1], "second")
+}
+
+func TestNull(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("name", storage.VarcharType(16), storage.NotNull)
+	st.AddColumn("age", storage.IntergerType)
+	st.AddColumn("bio", storage.TextType)
+
+	st.Add(1, "tychy", 20, nil)
+	st.Add(2, "yokonao", nil, "hello")
+	st.Add(3, "anonymous", nil, nil)
+	if err := st.Add(4, nil, 30, nil); err != storage.ErrNotNull {
+		t.Errorf("expected ErrNotNull, actual: %v", err)
+	}
+	if err := st.Add(nil, "nobody", 30, nil); err != storage.ErrNotNull {
+		t.Errorf("expected ErrNotNull, actual: %v", err)
+	}
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	res, err := st.Select(false, "age", "bio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0]) != 3 {
+		t.Fatalf("expected: 3 rows, actual: %d", len(res[0]))
+	}
+	if res[0][0].(int32) != 20 || res[0][1] != nil || res[0][2] != nil {
+		t.Errorf("unexpected ages: %v", res[0])
+	}
+	if res[1][0] != nil || res[1][1].(string) != "hello" || res[1][2] != nil {
+		t.Errorf("unexpected bios: %v", res[1])
+	}
+
+	ui := mustUpdate(t, st, 2, "age", 25)
+	st.Update(1, "bio", "world")
+	st.Update(1, "age", nil)
+	row, _ := st.Get(1)
+	if row[2] != nil || row[3].(string) != "world" {
+		t.Errorf("unexpected row: %v", row)
+	}
+	row, _ = st.Get(2)
+	assert.EqualInt32(t, row[2].(int32), 25)
+	ui.To = ui.From
+	if err := st.UpdateFromInfo(&ui); err != nil {
+		t.Fatal(err)
+	}
+	row, _ = st.Get(2)
+	if row[2] != nil {
+		t.Errorf("expected: nil, actual: %v", row[2])
+	}
+
+	rows, err := st.Rows(storage.IsNull("age"), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("expected: 3 rows, actual: %d", count)
+	}
+	rows, _ = st.Rows(storage.Lt("age", 100), "id")
+	if rows.Next() {
+		t.Errorf("comparison with null must be false: %v", rows.Values())
+	}
+}
+
+func TestNullPredicates(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	st := storage.NewStorage(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("age", storage.IntergerType)
+	st.Add(1, 20)
+	st.Add(2, nil)
+	st.Add(3, 30)
+
+	// NULLとの比較はunknownで、NOTしてもunknownのまま
+	tests := []struct {
+		pred     storage.Predicate
+		expected []int32
+	}{
+		{storage.Ne("age", 20), []int32{3}},
+		{storage.Not(storage.Eq("age", 20)), []int32{3}},
+		{storage.Not(storage.Lt("age", 100)), nil},
+		{storage.Or(storage.Eq("age", 20), storage.Not(storage.Eq("age", 20))), []int32{1, 3}},
+		{storage.Not(storage.And(storage.Eq("age", 20), storage.IsNull("age"))), []int32{1, 3}},
+		{storage.Not(storage.Or(storage.Eq("age", 20), storage.IsNull("age"))), []int32{3}},
+		{storage.Or(storage.Gt("age", 25), storage.IsNull("age")), []int32{2, 3}},
+		{storage.Not(storage.IsNotNull("age")), []int32{2}},
+	}
+	for i, test := range tests {
+		rows, err := st.Rows(test.pred, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int32
+		for rows.Next() {
+			ids = append(ids, rows.Values()[0].(int32))
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.expected) {
+			t.Errorf("%d: expected: %v, actual: %v", i, test.expected, ids)
+		}
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("name", storage.VarcharType(16))
+	st.AddColumn("memo", storage.CharType(8))
+	for i := 0; i < 10; i++ {
+		st.Add(i, fmt.Sprintf("user%d", i), "memo")
+	}
+
+	if err := st.AddColumnWithDefault("score", storage.IntergerType, 50, storage.NotNull); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AddColumnWithDefault("rank", storage.IntergerType, nil, storage.NotNull); err != storage.ErrNotNull {
+		t.Errorf("expected ErrNotNull, actual: %v", err)
+	}
+	if err := st.AddColumnWithDefault("score", storage.IntergerType, 0); err != storage.ErrColumnExists {
+		t.Errorf("expected ErrColumnExists, actual: %v", err)
+	}
+	st.Add(10, "user10", "new", 80)
+	if err := st.DropColumn("memo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DropColumn("id"); err != storage.ErrKeyColumn {
+		t.Errorf("expected ErrKeyColumn, actual: %v", err)
+	}
+	if err := st.RenameColumn("name", "username"); err != nil {
+		t.Fatal(err)
+	}
+	st.AddColumn("email", storage.VarcharType(32))
+	st.Add(11, "user11", 90, "user11@example.com")
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	res, err := st.Select(false, "id", "username", "score", "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0]) != 12 {
+		t.Fatalf("expected: 12 rows, actual: %d", len(res[0]))
+	}
+	for i := 0; i < 12; i++ {
+		assert.EqualInt32(t, res[0][i].(int32), int32(i))
+		assert.Equal(t, res[1][i], fmt.Sprintf("user%d", i))
+	}
+	assert.EqualInt32(t, res[2][3].(int32), 50)
+	assert.EqualInt32(t, res[2][10].(int32), 80)
+	if res[3][10] != nil || res[3][11] != "user11@example.com" {
+		t.Errorf("unexpected emails: %v", res[3])
+	}
+	if _, err := st.Select(false, "memo"); err != storage.ErrColumnNotFound {
+		t.Errorf("expected ErrColumnNotFound, actual: %v", err)
+	}
+
+	// 古いバージョンのレコードは書き換えたときに新しいバージョンで書き直される
+	st.Update(3, "email", "user3@example.com")
+	row, err := st.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, row[1], "user3")
+	assert.EqualInt32(t, row[2].(int32), 50)
+	assert.Equal(t, row[3], "user3@example.com")
+	if err := st.Delete(4); err != nil {
+		t.Error(err)
+	}
+	if _, err := st.Get(4); err != storage.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, actual: %v", err)
+	}
+}
+
+func TestAlterTableRepeatedly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(dir, storage.Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := db.Catalog().CreateTable("wide")
+	st.AddColumn("id", storage.IntergerType)
+	for i := 0; i < 10; i++ {
+		st.AddColumn(fmt.Sprintf("col%d", i), storage.VarcharType(16))
+	}
+	row := func(id int) []interface{} {
+		vals := []interface{}{id}
+		for i := 0; i < 10; i++ {
+			vals = append(vals, fmt.Sprintf("v%d", id))
+		}
+		return vals
+	}
+	// 毎回レコードが書かれるので、変更のたびにバージョンが上がる
+	for n := 0; n < 50; n++ {
+		if err := st.Add(row(n)...); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+		if err := st.RenameColumn("col0", "first"); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+		if err := st.AddColumnWithDefault("extra", storage.IntergerType, n); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+		if err := st.Add(append(row(1000+n), n)...); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+		if err := st.DropColumn("extra"); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+		if err := st.RenameColumn("first", "col0"); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+		if err := st.Flush(); err != nil {
+			t.Fatalf("cycle %d: %v", n, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, _ = db.Catalog().OpenTable("wide")
+	res, err := st.Select(false, "id", "col0", "col9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0]) != 100 {
+		t.Fatalf("expected 100 rows, actual: %d", len(res[0]))
+	}
+	for i, id := range res[0] {
+		v := fmt.Sprintf("v%d", id)
+		if res[1][i] != v || res[2][i] != v {
+			t.Errorf("unexpected row %v: %v %v", id, res[1][i], res[2][i])
+		}
+	}
+
+	// 履歴がなくても入らない変更はErrMetaFullになり、テーブルは変わらない
+	long := strings.Repeat("x", 900)
+	if err := st.AddColumnWithDefault(long, storage.IntergerType, nil); err != storage.ErrMetaFull {
+		t.Errorf("expected ErrMetaFull, actual: %v", err)
+	}
+	if err := st.RenameColumn("col1", long); err != storage.ErrMetaFull {
+		t.Errorf("expected ErrMetaFull, actual: %v", err)
+	}
+	if st.ColumnLength() != 11 {
+		t.Errorf("expected 11 columns, actual: %d", st.ColumnLength())
+	}
+	if err := st.Flush(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, fillFactor := range []float64{1.0, 0.5} {
+		fm := storage.NewFileMgr()
+		bm := storage.NewBufferMgr(fm)
+		ptb := storage.NewPageTable(bm)
+		st := storage.NewStorage(fm, ptb)
+		st.AddColumn("id", storage.IntergerType)
+		st.AddColumn("name", storage.VarcharType(16))
+		if err := st.CreateIndex([]string{"name"}, true); err != nil {
+			t.Fatal(err)
+		}
+
+		n := 3000
+		rows := [][]interface{}{}
+		for _, i := range rand.Perm(n) {
+			rows = append(rows, []interface{}{i, fmt.Sprintf("name%d", i)})
+		}
+		if err := st.BulkLoad(append(rows, []interface{}{n, "name0"}), fillFactor); err != storage.ErrDuplicateKey {
+			t.Errorf("expected ErrDuplicateKey, actual: %v", err)
+		}
+		if err := st.BulkLoad(rows, fillFactor); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.BulkLoad(rows, fillFactor); err != storage.ErrNotEmpty {
+			t.Errorf("expected ErrNotEmpty, actual: %v", err)
+		}
+		st.Flush()
+
+		st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+		keys := scanKeys(t, st, nil, nil, false)
+		if len(keys) != n {
+			t.Fatalf("expected: %d rows, actual: %d", n, len(keys))
+		}
+		for i, key := range keys {
+			assert.EqualInt32(t, key, int32(i))
+		}
+		equalKeys(t, scanKeys(t, st, 100, 104, true), 104, 103, 102, 101, 100)
+
+		// 一括ロードした木にもそのまま追加・削除できる
+		st.Add(n, "extra")
+		for i := 0; i < n; i += 2 {
+			if err := st.Delete(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := st.Lookup([]string{"name"}, "name1501")
+		if err != nil || len(res) != 1 {
+			t.Errorf("unexpected lookup result: %v, %v", res, err)
+		}
+		if _, err := st.Get(1500); err != storage.ErrKeyNotFound {
+			t.Errorf("expected ErrKeyNotFound, actual: %v", err)
+		}
+		assert.EqualInt32(t, int32(len(scanKeys(t, st, nil, nil, false))), int32(n/2+1))
+		fm.Clean()
+	}
+}
+
+func TestImport(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	cat := storage.NewCatalog(fm, ptb)
+	products, _ := cat.CreateTable("products")
+	products.AddColumn("id", storage.IntergerType)
+	products.AddColumn("name", storage.VarcharType(32))
+	products.AddColumn("price", storage.DecimalType(2))
+	products.AddColumn("released", storage.TimestampType)
+
+	csv := "name,id,price,released\n" +
+		"pen,3,1.50,2021-05-01T09:00:00+09:00\n" +
+		"\"notebook, A4\",1,3,\n" +
+		"eraser,2,,2021-04-01T00:00:00Z\n"
+	if err := products.ImportCSV(strings.NewReader(csv), 1.0); err != nil {
+		t.Fatal(err)
+	}
+	res, err := products.Select(false, "name", "price", "released")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res[0][0], "notebook, A4")
+	assert.Equal(t, res[1][0].(storage.Decimal).String(), "3.00")
+	if res[1][1] != nil || res[2][0] != nil {
+		t.Errorf("expected NULL, actual: %v, %v", res[1][1], res[2][0])
+	}
+	if res[2][2].(time.Time).Hour() != 9 {
+		t.Errorf("unexpected timestamp: %v", res[2][2])
+	}
+
+	events, _ := cat.CreateTable("events")
+	events.AddColumn("id", storage.BigIntType)
+	events.AddColumn("ok", storage.BooleanType)
+	events.AddColumn("score", storage.DoubleType)
+	jsonl := `{"id": 9007199254740993, "ok": true, "score": 0.25}
+{"id": 2, "ok": false}
+
+{"id": 1, "score": null}
+`
+	if err := events.ImportJSONL(strings.NewReader(jsonl), 0.7); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = events.Select(false, "id", "ok", "score")
+	if len(res[0]) != 3 || res[0][2].(int64) != 9007199254740993 {
+		t.Errorf("unexpected ids: %v", res[0])
+	}
+	if res[1][0] != nil || res[1][1] != false || res[2][2] != 0.25 {
+		t.Errorf("unexpected values: %v", res)
+	}
+	if err := events.ImportJSONL(strings.NewReader(`{"id": 5}`), 1.0); err != storage.ErrNotEmpty {
+		t.Errorf("expected ErrNotEmpty, actual: %v", err)
+	}
+}
+
+func TestLargeRecords(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("body", storage.VarcharType(1000))
+	if err := st.SetFillFactor(0.05); err != storage.ErrInvalidFillFactor {
+		t.Errorf("expected ErrInvalidFillFactor, actual: %v", err)
+	}
+	if err := st.SetFillFactor(0.7); err != nil {
+		t.Fatal(err)
+	}
+
+	// レコードの大きさがまちまちでも分割・併合できる
+	expected := map[int]string{}
+	for _, i := range rand.Perm(400) {
+		body := strings.Repeat(string(rune('a'+i%26)), rand.Intn(1000))
+		if err := st.Add(i, body); err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = body
+	}
+	for _, i := range rand.Perm(400)[:200] {
+		if err := st.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, i)
+	}
+	// 大きくなった値はページを分割して書き込まれる
+	for i := range expected {
+		body := strings.Repeat("z", 1000)
+		st.Update(i, "body", body)
+		expected[i] = body
+	}
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	res, err := st.Select(false, "id", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0]) != len(expected) {
+		t.Fatalf("expected: %d rows, actual: %d", len(expected), len(res[0]))
+	}
+	for i, id := range res[0] {
+		if res[1][i] != expected[int(id.(int32))] {
+			t.Errorf("unexpected body of %d", id)
+		}
+	}
+
+	wide := storage.NewStorage(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	wide.AddColumn("key", storage.VarcharType(1024))
+	for i := 0; i < 20; i++ {
+		wide.AddColumn(fmt.Sprintf("c%d", i), storage.CharType(255))
+	}
+	args := []interface{}{"k"}
+	for i := 0; i < 20; i++ {
+		args = append(args, "v")
+	}
+	if err := wide.Add(args...); err != storage.ErrRecordTooLarge {
+		t.Errorf("expected ErrRecordTooLarge, actual: %v", err)
+	}
+	key := storage.NewStorage(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	key.AddColumn("key", storage.VarcharType(1024))
+	if err := key.Add(strings.Repeat("k", 1024)); err != storage.ErrKeyTooLarge {
+		t.Errorf("expected ErrKeyTooLarge, actual: %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	fm := storage.NewFileMgr()
+	defer fm.Clean()
+
+	bm := storage.NewBufferMgr(fm)
+	ptb := storage.NewPageTable(bm)
+	st := storage.NewStorage(fm, ptb)
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("body", storage.VarcharType(200))
+	st.AddColumn("tag", storage.IntergerType)
+	st.CreateIndex([]string{"tag"}, false)
+
+	check := func(st *storage.Storage, expected map[int]string) {
+		t.Helper()
+		res, err := st.Select(false, "id", "body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res[0]) != len(expected) {
+			t.Fatalf("expected: %d rows, actual: %d", len(expected), len(res[0]))
+		}
+		for i, id := range res[0] {
+			if res[1][i] != expected[int(id.(int32))] {
+				t.Errorf("unexpected body of %d", id)
+			}
+		}
+	}
+
+	expected := map[int]string{}
+	for _, i := range rand.Perm(300) {
+		body := strings.Repeat("a", rand.Intn(200))
+		st.Add(i, body, i%7)
+		expected[i] = body
+	}
+	// 縮む更新は同じ位置に、伸びる更新は空き領域に書き込まれる
+	for i := 0; i < 300; i += 3 {
+		body := strings.Repeat("b", rand.Intn(200))
+		st.Update(i, "body", body)
+		expected[i] = body
+	}
+	for i := 1; i < 300; i += 2 {
+		st.Delete(i)
+		delete(expected, i)
+	}
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	check(st, expected)
+
+	st.Compact()
+	// 削除で空いたスロットに挿入される
+	for i := 1; i < 300; i += 4 {
+		body := strings.Repeat("c", rand.Intn(200))
+		st.Add(i, body, i%7)
+		expected[i] = body
+	}
+	st.Flush()
+
+	st = storage.NewStorageFromFile(fm, storage.NewPageTable(storage.NewBufferMgr(fm)))
+	check(st, expected)
+	res, err := st.Lookup([]string{"tag"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res {
+		if row[0].(int32)%7 != 3 {
+			t.Errorf("unexpected row: %v", row)
+		}
+	}
+}
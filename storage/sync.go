@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when committed writes are forced to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncPerCommit syncs the file on every commit.
+	SyncPerCommit SyncPolicy = iota
+	// SyncGroup makes concurrent commits wait for one sync shared by the group.
+	// The sync happens when GroupSize commits are waiting or Interval has passed since the first one.
+	SyncGroup
+	// SyncPeriodic syncs the file in the background every Interval. Commits don't wait,
+	// so the commits of the last Interval may be lost on power failure.
+	SyncPeriodic
+)
+
+const (
+	DefaultGroupSize    = 8
+	DefaultSyncInterval = 10 * time.Millisecond
+)
+
+// SyncOptions configures the SyncPolicy of the log file.
+type SyncOptions struct {
+	Policy SyncPolicy
+	// GroupSize is the number of commits synced together by SyncGroup. 0 means DefaultGroupSize.
+	GroupSize int
+	// Interval is the longest wait of a commit under SyncGroup and the period of SyncPeriodic.
+	// 0 means DefaultSyncInterval.
+	Interval time.Duration
+}
+
+func (opts SyncOptions) groupSize() int {
+	if opts.GroupSize <= 0 {
+		return DefaultGroupSize
+	}
+	return opts.GroupSize
+}
+
+func (opts SyncOptions) interval() time.Duration {
+	if opts.Interval <= 0 {
+		return DefaultSyncInterval
+	}
+	return opts.Interval
+}
+
+// Syncer syncs a file at commits according to the SyncPolicy of its FileMgr.
+type Syncer struct {
+	fm       *FileMgr
+	fileName string
+	opts     SyncOptions
+
+	mu      sync.Mutex
+	synced  *sync.Cond
+	pending int    // 同期を待っているコミットの数
+	gen     uint64 // 同期のたびに増える
+	dirty   bool   // 前回の同期の後に書き込まれたか
+	err     error  // 直近の同期のエラー
+	bgErr   error  // バックグラウンドの同期のエラーで、まだ返していないもの
+	syncs   uint64 // 同期した回数
+	timer   *time.Timer
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// NewSyncer returns a Syncer of fileName using the SyncOptions given to Open.
+// Close must be called to stop the background sync of SyncPeriodic.
+func (fm *FileMgr) NewSyncer(fileName string) *Syncer {
+	s := &Syncer{fm: fm, fileName: fileName, opts: fm.syncOpts}
+	s.synced = sync.NewCond(&s.mu)
+	if s.opts.Policy == SyncPeriodic {
+		s.stop = make(chan struct{})
+		s.stopped.Add(1)
+		go s.run()
+	}
+	return s
+}
+
+// Commit makes the writes to the file before the call durable as the policy requires.
+// Under SyncPeriodic it returns the error of the last background sync, if any.
+func (s *Syncer) Commit() error {
+	switch s.opts.Policy {
+	case SyncGroup:
+		return s.commitGroup()
+	case SyncPeriodic:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.dirty = true
+		err := s.bgErr
+		s.bgErr = nil
+		return err
+	default:
+		err := s.fm.Sync(s.fileName)
+		s.mu.Lock()
+		s.syncs++
+		s.mu.Unlock()
+		return err
+	}
+}
+
+// Syncs returns the number of times the file has been synced by s.
+func (s *Syncer) Syncs() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+func (s *Syncer) commitGroup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gen := s.gen
+	s.pending++
+	if s.pending >= s.opts.groupSize() {
+		s.syncLocked()
+	} else if s.pending == 1 {
+		// グループの最初のコミットが待ちすぎないようにする
+		s.timer = time.AfterFunc(s.opts.interval(), s.flushGroup)
+	}
+	for s.gen == gen {
+		s.synced.Wait()
+	}
+	return s.err
+}
+
+func (s *Syncer) flushGroup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending > 0 {
+		s.syncLocked()
+	}
+}
+
+func (s *Syncer) syncLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.err = s.fm.Sync(s.fileName)
+	s.syncs++
+	s.pending = 0
+	s.dirty = false
+	s.gen++
+	s.synced.Broadcast()
+}
+
+func (s *Syncer) run() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.opts.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty {
+				s.syncLocked()
+				if s.err != nil && s.bgErr == nil {
+					s.bgErr = s.err
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background sync and syncs the writes not synced yet.
+func (s *Syncer) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.stopped.Wait()
+		s.stop = nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.bgErr
+	s.bgErr = nil
+	if s.dirty || s.pending > 0 {
+		s.syncLocked()
+		if err == nil {
+			err = s.err
+		}
+	}
+	return err
+}
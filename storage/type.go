@@ -5,6 +5,14 @@ type TypeId uint32
 const (
 	integerId = iota
 	charId
+	varcharId
+	textId
+	blobId
+	bigintId
+	booleanId
+	doubleId
+	timestampId
+	decimalId
 )
 
 func (id TypeId) String() string {
@@ -13,6 +21,22 @@ func (id TypeId) String() string {
 		return "INTEGER"
 	case charId:
 		return "CHAR"
+	case varcharId:
+		return "VARCHAR"
+	case textId:
+		return "TEXT"
+	case blobId:
+		return "BLOB"
+	case bigintId:
+		return "BIGINT"
+	case booleanId:
+		return "BOOLEAN"
+	case doubleId:
+		return "DOUBLE"
+	case timestampId:
+		return "TIMESTAMP"
+	case decimalId:
+		return "DECIMAL"
 	default:
 		return "Unknown"
 	}
@@ -27,8 +51,37 @@ func (t Type) String() string {
 	return t.id.String()
 }
 
+// isVariable reports whether values of the type are stored in the variable-length area of a record.
+func (t Type) isVariable() bool {
+	return t.id == varcharId || t.id == textId || t.id == blobId
+}
+
+// isLarge reports whether values of the type may be moved to overflow pages.
+func (t Type) isLarge() bool {
+	return t.id == textId || t.id == blobId
+}
+
 var IntergerType Type = Type{id: integerId, size: 4}
 
+var (
+	BigIntType  Type = Type{id: bigintId, size: 8}
+	BooleanType Type = Type{id: booleanId, size: 1}
+	DoubleType  Type = Type{id: doubleId, size: 8}
+	// TIMESTAMPはUTCのナノ秒と、タイムゾーンのオフセット(秒)を保存する
+	TimestampType Type = Type{id: timestampId, size: 12}
+)
+
+const maxDecimalScale = 18
+
+// DecimalType is a fixed-point number with scale digits after the decimal point.
+// DECIMALは10^scale倍した値をint64で保存するので、sizeにはscaleを入れておく
+func DecimalType(scale uint32) Type {
+	if scale > maxDecimalScale {
+		panic("maximum decimal scale is 18. specify less than that.")
+	}
+	return Type{id: decimalId, size: scale}
+}
+
 const maxCharLen = 255
 
 func CharType(cap uint32) Type {
@@ -37,3 +90,19 @@ func CharType(cap uint32) Type {
 	}
 	return Type{id: charId, size: cap}
 }
+
+// VARCHARは実際の長さだけ保存するが、1ページに収まる必要がある
+const maxVarcharLen = 1024
+
+func VarcharType(cap uint32) Type {
+	if cap > maxVarcharLen {
+		panic("maximum varchar size is 1024. specify less than that or use TEXT.")
+	}
+	return Type{id: varcharId, size: cap}
+}
+
+// TEXT and BLOB have no size limit. Values longer than maxInlineLen are stored in overflow pages.
+var (
+	TextType Type = Type{id: textId}
+	BlobType Type = Type{id: blobId}
+)
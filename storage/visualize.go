@@ -10,6 +10,8 @@ import (
 )
 
 func (st *Storage) Viz(fname string) {
+	st.latch.RLock()
+	defer st.latch.RUnlock()
 	g := graphviz.New()
 	graph, err := g.Graph()
 	if err != nil {
@@ -21,6 +23,7 @@ func (st *Storage) Viz(fname string) {
 		}
 		g.Close()
 	}()
+	keyCols := st.keyCols()
 	pageQueue := algorithm.NewQueue(64)
 	nodeMap := make(map[uint32]*cgraph.Node)
 	parentMap := make(map[uint32]uint32)
@@ -28,17 +31,24 @@ func (st *Storage) Viz(fname string) {
 	pageQueue.Push(int(st.rootBlk.BlockNum))
 
 	parentMap[st.rootBlk.BlockNum] = st.rootBlk.BlockNum
+	ring := st.ptb.newRing()
 
 	for !pageQueue.IsEmpty() {
 		curPageIndex := uint32(pageQueue.Pop())
-		curPage := st.ptb.read(NewBlockId(curPageIndex, StorageFile))
+		curBlk := NewBlockId(curPageIndex, StorageFile)
+		curPage, err := st.ptb.latchWith(curBlk, latchShared, ring)
+		if err != nil {
+			log.Fatal(err)
+		}
 		parentIndex := parentMap[curPageIndex]
 		str := strconv.Itoa(int(curPageIndex)) + ", key:"
 		for _, ptr := range curPage.ptrs {
-			str += strconv.Itoa(int(curPage.cells[ptr].getKey())) + ", "
+			str += keyString(keyCols, curPage.cells[ptr].getKey()) + ", "
 		}
 		if !curPage.header.isLeaf {
-			str += strconv.Itoa(int(curPage.cells[curPage.header.rightmostPtr].getKey()))
+			if key := curPage.cells[curPage.header.rightmostPtr].getKey(); len(key) > 0 {
+				str += keyString(keyCols, key)
+			}
 		}
 		c, err := graph.CreateNode(str)
 		if err != nil {
@@ -59,7 +69,7 @@ func (st *Storage) Viz(fname string) {
 			for _, ptr := range curPage.ptrs {
 				keyValue := curPage.cells[ptr]
 				key := keyValue.(KeyValueCell).key
-				v, err := graph.CreateNode("L:" + strconv.Itoa(int(key)))
+				v, err := graph.CreateNode("L:" + keyString(keyCols, key))
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -79,6 +89,7 @@ func (st *Storage) Viz(fname string) {
 			pageQueue.Push(int(child))
 			parentMap[child] = curPageIndex
 		}
+		st.ptb.unlatch(curBlk, latchShared)
 	}
 	if err := g.RenderFilename(graph, graphviz.PNG, fname+".png"); err != nil {
 		log.Fatal(err)
@@ -2,8 +2,7 @@ package transaction
 
 import "github.com/tychyDB/storage"
 
-func CreateLogFile() {
-	UniqueTxnId = 0
+func CreateLogFile() error {
 	storage.CreateStorage()
 
 	logfm := storage.NewFileMgr()
@@ -12,8 +11,16 @@ func CreateLogFile() {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := NewLogMgr(*logfm)
+	lm := NewLogMgr(logfm)
 	rm := NewRecoveryMgr(lm, ptb)
+	tm := NewTxnMgr()
+	update := func(txn *Transaction, prVal interface{}, fuga interface{}) error {
+		updateInfo, err := st.Update(prVal, "fuga", fuga)
+		if err != nil {
+			return err
+		}
+		return rm.Update(txn, updateInfo)
+	}
 	/*
 	   | hoge  | fuga  | piyo  |
 	   | --    | --    | --    |
@@ -27,34 +34,41 @@ func CreateLogFile() {
 	   | 80000 | 10    | 0     |
 	*/
 
-	txnA := NewTransaction()
+	txnA := tm.NewTransaction()
 	rm.Begin(txnA)
-	updateInfo := st.Update(500, "fuga", 33)
-	rm.Update(txnA, updateInfo)
-	updateInfo = st.Update(2, "fuga", 3337)
-	rm.Update(txnA, updateInfo)
+	if err := update(txnA, 500, 33); err != nil {
+		return err
+	}
+	if err := update(txnA, 2, 3337); err != nil {
+		return err
+	}
 	rm.Commit(txnA)
 
-	txnB := NewTransaction()
-	txnC := NewTransaction()
+	txnB := tm.NewTransaction()
+	txnC := tm.NewTransaction()
 	rm.Begin(txnB)
-	updateInfo = st.Update(2, "fuga", 44)
-	rm.Update(txnB, updateInfo)
+	if err := update(txnB, 2, 44); err != nil {
+		return err
+	}
 
 	rm.Begin(txnC)
-	updateInfo = st.Update(2, "fuga", 4447)
-	rm.Update(txnB, updateInfo)
-	updateInfo = st.Update(2, "fuga", 5557)
-	rm.Update(txnC, updateInfo)
+	if err := update(txnB, 2, 4447); err != nil {
+		return err
+	}
+	if err := update(txnC, 2, 5557); err != nil {
+		return err
+	}
 	rm.Abort(txnC)
 	rm.Commit(txnB)
 
-	txnD := NewTransaction()
+	txnD := tm.NewTransaction()
 	rm.Begin(txnD)
-	updateInfo = st.Update(2, "fuga", 66)
-	rm.Update(txnD, updateInfo)
-	updateInfo = st.Update(2, "fuga", 6667)
-	rm.Update(txnD, updateInfo)
+	if err := update(txnD, 2, 66); err != nil {
+		return err
+	}
+	if err := update(txnD, 2, 6667); err != nil {
+		return err
+	}
 
 	/*
 	| hoge  | fuga  | piyo  |
@@ -68,6 +82,8 @@ func CreateLogFile() {
 	| 10000 | 4     | 44    |
 	| 80000 | 10    | 0     |
 	*/
-	st.Clear()
-	st.Flush()
+	if err := st.Clear(); err != nil {
+		return err
+	}
+	return st.Flush()
 }
@@ -2,49 +2,62 @@ package transaction
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/tychyDB/storage"
 )
 
 const LogFile = "log"
 
+// LogMgr appends logs to the log file. It is safe for concurrent use.
 type LogMgr struct {
+	mu            sync.Mutex
 	UniqueLSN     uint32
 	UniquePageNum uint32
 	LogPage       *LogPage // I used UpperCase for testing, but this should be lowerCamelCase.
-	fm            storage.FileMgr
+	fm            *storage.FileMgr
+	syncer        *storage.Syncer
 	FlashedLSN    uint32
 }
 
-func NewLogMgr(fm storage.FileMgr) *LogMgr {
+func NewLogMgr(fm *storage.FileMgr) *LogMgr {
 	logMgr := LogMgr{}
 	logMgr.UniqueLSN = 1 // 1-indexed, because flushed lsn is 0
 	logMgr.UniquePageNum = 0
 	logMgr.fm = fm
+	logMgr.syncer = fm.NewSyncer(LogFile)
 	logMgr.FlashedLSN = 0
-	logMgr.LogPage = newLogPage(logMgr.getUniquePageNum())
+	logMgr.LogPage = newLogPage(logMgr.getUniquePageNum(), fm.PageSize())
 	return &logMgr
 }
 
-func NewLogMgrFromFile(fm storage.FileMgr) *LogMgr {
+func NewLogMgrFromFile(fm *storage.FileMgr) (*LogMgr, error) {
 	logMgr := LogMgr{}
 	logMgr.fm = fm
-	blk, n, buf := fm.ReadLastBlock(LogFile)
+	logMgr.syncer = fm.NewSyncer(LogFile)
+	blk, n, buf, err := fm.ReadLastBlock(LogFile)
+	if err != nil {
+		return nil, err
+	}
 	if n == 0 {
-		panic(errors.New("page is empty"))
+		return nil, errors.New("page is empty")
 	}
 	logMgr.UniquePageNum = uint32(blk) + 1
 	logMgr.LogPage = NewLogPageFromBytes(buf)
 	logMgr.FlashedLSN = logMgr.LogPage.maxLSN()
 	logMgr.UniqueLSN = logMgr.FlashedLSN + 1
-	return &logMgr
+	return &logMgr, nil
 }
 
 func (lm *LogMgr) logAt(idx uint32) (Log, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 	return lm.LogPage.logAt(idx)
 }
 
 func (lm *LogMgr) isEnd(idx uint32) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 	return lm.LogPage.isEnd(idx)
 }
 
@@ -61,16 +74,52 @@ func (lm *LogMgr) getUniquePageNum() uint32 {
 }
 
 func (lm *LogMgr) addLog(txnId TxnId, logType uint32) *Log {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 	log := newUniqueLog(lm.getUniqueLSN(), txnId, logType)
 	lm.LogPage.addLog(log)
 	return log
 }
 
-func (lm *LogMgr) WritePage() {
-	lm.fm.Write(lm.LogPage.blk, lm.LogPage.ToBytes())
-	lm.FlashedLSN = lm.LogPage.maxLSN()
+// addUpdateLog adds an UPDATE log. The log is filled before it is added
+// so that WritePage never sees it half written.
+func (lm *LogMgr) addUpdateLog(txnId TxnId, updateInfo storage.UpdateInfo) *Log {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	log := newUniqueLog(lm.getUniqueLSN(), txnId, UPDATE)
+	log.addUpdateInfo(updateInfo)
+	lm.LogPage.addLog(log)
+	return log
+}
+
+// WritePage writes the log page and syncs it according to the SyncPolicy of the FileMgr.
+// 同期を待つ間はmuを外し、ほかのコミットが同じグループに入れるようにする
+func (lm *LogMgr) WritePage() error {
+	lm.mu.Lock()
+	lsn := lm.LogPage.maxLSN()
+	err := lm.fm.Write(lm.LogPage.blk, lm.LogPage.ToBytes())
+	lm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := lm.syncer.Commit(); err != nil {
+		return err
+	}
+	lm.mu.Lock()
+	if lsn > lm.FlashedLSN {
+		lm.FlashedLSN = lsn
+	}
+	lm.mu.Unlock()
+	return nil
+}
+
+// Close syncs the log not synced yet and stops the background sync.
+func (lm *LogMgr) Close() error {
+	return lm.syncer.Close()
 }
 
 func (lm *LogMgr) Print() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 	lm.LogPage.Print()
 }
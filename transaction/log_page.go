@@ -17,11 +17,13 @@ type LogPage struct {
 	isFull  bool
 	numLogs uint32
 	logs    []*Log
+	size    uint32
 }
 
-func newLogPage(pageNum uint32) *LogPage {
+func newLogPage(pageNum uint32, size uint32) *LogPage {
 	logPage := &LogPage{}
 	logPage.blk = storage.NewBlockId(pageNum, LogFile)
+	logPage.size = size
 	logPage.isFull = false
 	logPage.numLogs = 0
 	return logPage
@@ -33,6 +35,7 @@ func NewLogPageFromBytes(bytes []byte) *LogPage {
 	blk := storage.NewBlockId(blockNum, LogFile)
 	pg := &LogPage{}
 	pg.blk = blk
+	pg.size = uint32(len(bytes))
 	pg.isFull = iter.NextBool()
 	pg.numLogs = iter.NextUInt32()
 	pg.logs = make([]*Log, pg.numLogs)
@@ -61,7 +64,7 @@ func NewLogPageFromBytes(bytes []byte) *LogPage {
 }
 
 func (pg *LogPage) ToBytes() []byte {
-	gen := util.NewGenStruct(0, storage.PageSize)
+	gen := util.NewGenStruct(0, pg.size)
 	gen.PutUInt32(pg.blk.BlockNum)
 	gen.PutBool(pg.isFull)
 	gen.PutUInt32(pg.numLogs)
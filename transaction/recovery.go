@@ -20,21 +20,20 @@ func (rm *RecoveryMgr) Begin(txn *Transaction) {
 	rm.lm.addLog(txn.txnId, BEGIN)
 }
 
-func (rm *RecoveryMgr) Commit(txn *Transaction) {
+func (rm *RecoveryMgr) Commit(txn *Transaction) error {
 	rm.lm.addLog(txn.txnId, COMMIT)
-	rm.lm.WritePage()
+	return rm.lm.WritePage()
 }
 func (rm *RecoveryMgr) Abort(txn *Transaction) {
 	rm.lm.addLog(txn.txnId, ABORT)
 }
 
-func (rm *RecoveryMgr) Update(txn *Transaction, updateInfo storage.UpdateInfo) {
-	log := rm.lm.addLog(txn.txnId, UPDATE)
-	log.addUpdateInfo(updateInfo)
-	rm.ptb.SetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile), log.lsn)
+func (rm *RecoveryMgr) Update(txn *Transaction, updateInfo storage.UpdateInfo) error {
+	log := rm.lm.addUpdateLog(txn.txnId, updateInfo)
+	return rm.ptb.SetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile), log.lsn)
 }
 
-func (rm *RecoveryMgr) LogRedo(st *storage.Storage) {
+func (rm *RecoveryMgr) LogRedo(st *storage.Storage) error {
 	redoPool := map[TxnId]bool{}
 	txnTable := map[TxnId]TxnStatus{}
 	// log file full scan
@@ -42,7 +41,7 @@ func (rm *RecoveryMgr) LogRedo(st *storage.Storage) {
 	for !logIter.IsEnd() {
 		log, err := logIter.Next()
 		if err != nil {
-			panic(ErrOutOfBounds)
+			return ErrOutOfBounds
 		}
 		switch log.logType {
 		case BEGIN:
@@ -64,7 +63,7 @@ func (rm *RecoveryMgr) LogRedo(st *storage.Storage) {
 	for !logIter.IsEnd() {
 		log, err := logIter.Next()
 		if err != nil {
-			panic(ErrOutOfBounds)
+			return ErrOutOfBounds
 		}
 
 		switch log.logType {
@@ -72,11 +71,13 @@ func (rm *RecoveryMgr) LogRedo(st *storage.Storage) {
 			continue
 		case UPDATE:
 			if redoPool[log.txnId] {
-				st.UpdateFromInfo(&log.updateInfo)
+				if err := st.UpdateFromInfo(&log.updateInfo); err != nil {
+					return err
+				}
 			}
 		default:
 			panic(ErrNotImplemented)
 		}
 	}
-	st.Flush()
+	return st.Flush()
 }
@@ -1,8 +1,8 @@
 package transaction
 
-type TxnId uint32
+import "sync"
 
-var UniqueTxnId TxnId
+type TxnId uint32
 
 type TxnStatus uint32
 
@@ -12,13 +12,40 @@ const (
 	TXN_COMMITED
 )
 
-func init() {
-	UniqueTxnId = 0
+// TxnMgr hands out the ids of transactions.
+// Each database has its own TxnMgr, so the ids of different databases don't interfere.
+type TxnMgr struct {
+	mu        sync.Mutex
+	nextTxnId TxnId
+}
+
+func NewTxnMgr() *TxnMgr {
+	tm := &TxnMgr{}
+	tm.nextTxnId = 0
+	return tm
 }
 
-func getUniqueTxnId() TxnId {
-	res := UniqueTxnId
-	UniqueTxnId++
+// NewTxnMgrFromLog returns a TxnMgr whose ids follow the ones recorded in the log.
+func NewTxnMgrFromLog(lm *LogMgr) (*TxnMgr, error) {
+	tm := NewTxnMgr()
+	logIter := NewLogIter(lm, 0)
+	for !logIter.IsEnd() {
+		log, err := logIter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if log.txnId >= tm.nextTxnId {
+			tm.nextTxnId = log.txnId + 1
+		}
+	}
+	return tm, nil
+}
+
+func (tm *TxnMgr) getUniqueTxnId() TxnId {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	res := tm.nextTxnId
+	tm.nextTxnId++
 	return res
 }
 
@@ -26,8 +53,10 @@ type Transaction struct {
 	txnId TxnId
 }
 
-func NewTransaction() *Transaction {
+func (tm *TxnMgr) NewTransaction() *Transaction {
 	txn := &Transaction{}
-	txn.txnId = getUniqueTxnId()
+	txn.txnId = tm.getUniqueTxnId()
 	return txn
 }
+
+func (txn *Transaction) TxnID() TxnId { return txn.txnId }
@@ -1,7 +1,11 @@
 package transaction_test
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/tychyDB/assert"
@@ -15,6 +19,22 @@ func cleanDisk(t *testing.T) {
 	os.Remove(diskDir + "/logfile")
 }
 
+func pageLSN(t *testing.T, ptb *storage.PageTable, ui storage.UpdateInfo) uint32 {
+	lsn, err := ptb.GetPageLSN(storage.NewBlockId(ui.PageIdx, storage.StorageFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lsn
+}
+
+func update(t *testing.T, st *storage.Storage, prVal interface{}, colName string, v interface{}) storage.UpdateInfo {
+	ui, err := st.Update(prVal, colName, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ui
+}
+
 func createStorage(t *testing.T) {
 	cleanDisk(t)
 	fm := storage.NewFileMgr()
@@ -36,7 +56,7 @@ func createStorage(t *testing.T) {
 }
 
 func TestTxn(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	createStorage(t)
 	logfm := storage.NewFileMgr()
 	defer logfm.Clean()
@@ -46,18 +66,18 @@ func TestTxn(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	tb := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
 
-	txn := transaction.NewTransaction()
+	txn := tm.NewTransaction()
 	rm.Begin(txn)
-	updateInfo := tb.Update(2, "fuga", 33)
+	updateInfo := update(t, tb, 2, "fuga", 33)
 	rm.Update(txn, updateInfo)
 	rm.Commit(txn)
 }
 
 func TestLogSerializeDeSerialize(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	createStorage(t)
 	logfm := storage.NewFileMgr()
 	defer logfm.Clean()
@@ -67,12 +87,12 @@ func TestLogSerializeDeSerialize(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
-	txn := transaction.NewTransaction()
+	txn := tm.NewTransaction()
 
 	rm.Begin(txn)
-	updateInfo := st.Update(2, "fuga", 33)
+	updateInfo := update(t, st, 2, "fuga", 33)
 	rm.Update(txn, updateInfo)
 	rm.Commit(txn)
 
@@ -93,7 +113,7 @@ func TestLogSerializeDeSerialize(t *testing.T) {
 }
 
 func TestLogLSN(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	createStorage(t)
 	logfm := storage.NewFileMgr()
 	defer logfm.Clean()
@@ -103,24 +123,24 @@ func TestLogLSN(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
-	txn := transaction.NewTransaction()
+	txn := tm.NewTransaction()
 
 	rm.Begin(txn)
-	updateInfo := st.Update(2, "fuga", 33)
+	updateInfo := update(t, st, 2, "fuga", 33)
 	rm.Update(txn, updateInfo)
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 2)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 2)
 
 	st.Flush()
 	st = storage.NewStorageFromFile(fm, ptb)
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 2)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 2)
 
 	rm.Commit(txn)
 }
 
 func TestLogLSNConcurrently(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	createStorage(t)
 	logfm := storage.NewFileMgr()
 	defer logfm.Clean()
@@ -130,34 +150,34 @@ func TestLogLSNConcurrently(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
 
-	txnA := transaction.NewTransaction()
-	txnB := transaction.NewTransaction()
+	txnA := tm.NewTransaction()
+	txnB := tm.NewTransaction()
 
 	rm.Begin(txnA)
-	updateInfo := st.Update(2, "fuga", 33)
+	updateInfo := update(t, st, 2, "fuga", 33)
 	rm.Update(txnA, updateInfo)
 
 	rm.Begin(txnB)
-	updateInfo = st.Update(2, "fuga", 3335)
+	updateInfo = update(t, st, 2, "fuga", 3335)
 
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 2)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 2)
 
 	rm.Update(txnA, updateInfo)
 
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 4)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 4)
 	rm.Abort(txnB)
 	rm.Commit(txnA)
 
 	st.Flush()
 	st = storage.NewStorageFromFile(fm, ptb)
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 4)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 4)
 }
 
 func TestLogIterator(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	createStorage(t)
 	logfm := storage.NewFileMgr()
 	defer logfm.Clean()
@@ -166,11 +186,11 @@ func TestLogIterator(t *testing.T) {
 
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
 
-	txnA := transaction.NewTransaction()
-	txnB := transaction.NewTransaction()
+	txnA := tm.NewTransaction()
+	txnB := tm.NewTransaction()
 
 	rm.Begin(txnA)
 	rm.Begin(txnB)
@@ -205,7 +225,7 @@ func TestLogIterator(t *testing.T) {
 }
 
 func TestUpdateFromLog(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	createStorage(t)
 	logfm := storage.NewFileMgr()
 	defer logfm.Clean()
@@ -215,30 +235,30 @@ func TestUpdateFromLog(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
-	txn := transaction.NewTransaction()
+	txn := tm.NewTransaction()
 
 	rm.Begin(txn)
-	updateInfo := st.Update(2, "fuga", 33)
+	updateInfo := update(t, st, 2, "fuga", 33)
 	rm.Update(txn, updateInfo)
 
-	updateInfo = st.Update(2, "fuga", 3335)
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 2)
+	updateInfo = update(t, st, 2, "fuga", 3335)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 2)
 
 	rm.Update(txn, updateInfo)
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 3)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 3)
 
 	st.Flush()
 	st = storage.NewStorageFromFile(fm, ptb)
-	assert.EqualUInt32(t, ptb.GetPageLSN(storage.NewBlockId(updateInfo.PageIdx, storage.StorageFile)), 3)
+	assert.EqualUInt32(t, pageLSN(t, ptb, updateInfo), 3)
 
 	rm.Commit(txn)
 	st.Select(false)
 }
 
 func TestRedoFromLog(t *testing.T) {
-	transaction.UniqueTxnId = 0
+	tm := transaction.NewTxnMgr()
 	storage.CreateStorage()
 
 	logfm := storage.NewFileMgr()
@@ -249,15 +269,15 @@ func TestRedoFromLog(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgr(*logfm)
+	lm := transaction.NewLogMgr(logfm)
 	rm := transaction.NewRecoveryMgr(lm, ptb)
-	txn := transaction.NewTransaction()
+	txn := tm.NewTransaction()
 
 	rm.Begin(txn)
-	updateInfo := st.Update(500, "fuga", 33)
+	updateInfo := update(t, st, 500, "fuga", 33)
 	rm.Update(txn, updateInfo)
 
-	updateInfo = st.Update(2, "fuga", 3337)
+	updateInfo = update(t, st, 2, "fuga", 3337)
 	rm.Update(txn, updateInfo)
 
 	rm.Commit(txn)
@@ -273,15 +293,18 @@ func TestRedoFromLog(t *testing.T) {
 	res, _ = st.Select(false, "hoge", "fuga")
 	assert.EqualInt32(t, res[1][3].(int32), -13)
 	assert.EqualInt32(t, res[1][5].(int32), 5)
-	rm.LogRedo(&st)
+	if err := rm.LogRedo(st); err != nil {
+		t.Fatal(err)
+	}
 	res, _ = st.Select(false, "hoge", "fuga")
 	assert.EqualInt32(t, res[1][3].(int32), 3337)
 	assert.EqualInt32(t, res[1][5].(int32), 33)
 }
 
 func TestRedoFromLogFile(t *testing.T) {
-	transaction.UniqueTxnId = 0
-	transaction.CreateLogFile()
+	if err := transaction.CreateLogFile(); err != nil {
+		t.Fatal(err)
+	}
 
 	fm := storage.NewFileMgr()
 	defer fm.Clean()
@@ -289,14 +312,142 @@ func TestRedoFromLogFile(t *testing.T) {
 	bm := storage.NewBufferMgr(fm)
 	ptb := storage.NewPageTable(bm)
 	st := storage.NewStorageFromFile(fm, ptb)
-	lm := transaction.NewLogMgrFromFile(*fm)
+	lm, err := transaction.NewLogMgrFromFile(fm)
+	if err != nil {
+		t.Fatal(err)
+	}
 	rm := transaction.NewRecoveryMgr(lm, ptb)
+	// コミットされずに書き出されていないtxnDのidから振り直す
+	tm, err := transaction.NewTxnMgrFromLog(lm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualUInt32(t, uint32(tm.NewTransaction().TxnID()), 3)
 
 	res, _ := st.Select(false, "hoge", "fuga", "piyo")
 	assert.EqualInt32(t, res[1][3].(int32), -13)
 	assert.EqualInt32(t, res[1][5].(int32), 5)
-	rm.LogRedo(&st)
+	if err := rm.LogRedo(st); err != nil {
+		t.Fatal(err)
+	}
 	res, _ = st.Select(false, "hoge", "fuga", "piyo")
 	assert.EqualInt32(t, res[1][3].(int32), 4447)
 	assert.EqualInt32(t, res[1][5].(int32), 33)
 }
+
+func TestLogDir(t *testing.T) {
+	dir := t.TempDir()
+	logDir := filepath.Join(dir, "wal")
+	db, err := storage.Open(filepath.Join(dir, "data"), storage.Options{PageSize: 2048, LogDir: logDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := db.Catalog().CreateTable("users")
+	st.AddColumn("id", storage.IntergerType)
+	st.AddColumn("age", storage.IntergerType)
+	st.Add(1, 20)
+
+	lm := transaction.NewLogMgr(db.LogFileMgr())
+	rm := transaction.NewRecoveryMgr(lm, db.PageTable())
+	tm := transaction.NewTxnMgr()
+	txn := tm.NewTransaction()
+	rm.Begin(txn)
+	rm.Update(txn, update(t, st, 1, "age", 21))
+	rm.Commit(txn)
+	db.Close()
+
+	info, err := os.Stat(filepath.Join(logDir, transaction.LogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2048 {
+		t.Errorf("expected: 2048, actual: %d", info.Size())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", transaction.LogFile)); err == nil {
+		t.Error("log file must not be in the data directory")
+	}
+}
+
+func TestIndependentDatabases(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	var dbs []*storage.DB
+	var tables []*storage.Storage
+	for _, dir := range dirs {
+		db, err := storage.Open(dir, storage.Options{PageSize: 2048})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ := db.Catalog().CreateTable("docs")
+		st.AddColumn("id", storage.IntergerType)
+		st.AddColumn("body", storage.TextType)
+		dbs = append(dbs, db)
+		tables = append(tables, st)
+	}
+	// 交互に書いても、それぞれのファイルのブロックは独立に確保される
+	for i := 0; i < 200; i++ {
+		for j, st := range tables {
+			if err := st.Add(i, strings.Repeat(fmt.Sprint(j), 100*(i%30))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// txnのidもデータベースごとに0から振られ、並行に取っても重ならない
+	tms := []*transaction.TxnMgr{transaction.NewTxnMgr(), transaction.NewTxnMgr()}
+	n := 100
+	ids := make([][]bool, len(tms))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for j, tm := range tms {
+		ids[j] = make([]bool, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(j int, tm *transaction.TxnMgr) {
+				defer wg.Done()
+				id := tm.NewTransaction().TxnID()
+				mu.Lock()
+				defer mu.Unlock()
+				if int(id) >= n || ids[j][id] {
+					t.Errorf("unexpected txn id %d in database %d", id, j)
+					return
+				}
+				ids[j][id] = true
+			}(j, tm)
+		}
+	}
+	wg.Wait()
+
+	for _, db := range dbs {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sizes []int64
+	for j, dir := range dirs {
+		info, err := os.Stat(filepath.Join(dir, storage.StorageFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+
+		db, err := storage.Open(dir, storage.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := db.Catalog().OpenTable("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := st.Get(199)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := res[1].(string); body != strings.Repeat(fmt.Sprint(j), 1900) {
+			t.Errorf("unexpected body in database %d: %.20s", j, body)
+		}
+		db.Close()
+	}
+	if sizes[0] != sizes[1] {
+		t.Errorf("expected the same file sizes, actual: %v", sizes)
+	}
+}